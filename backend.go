@@ -2,10 +2,12 @@ package jwtauth
 
 import (
 	"context"
+	"strings"
 	"sync"
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
+	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	cache "github.com/patrickmn/go-cache"
@@ -14,6 +16,12 @@ import (
 const (
 	configPath string = "config"
 	rolePrefix string = "role/"
+
+	oidcStateCleanupInterval = 30 * time.Second
+
+	// minRediscoveryInterval limits how often the provider's metadata is
+	// re-discovered after requests to its endpoints fail.
+	minRediscoveryInterval = time.Minute
 )
 
 // Factory is used by framework
@@ -30,9 +38,13 @@ type jwtAuthBackend struct {
 
 	l            sync.RWMutex
 	provider     *oidc.Provider
+	keySet       oidc.KeySet
 	cachedConfig *jwtConfig
 	oidcStates   *cache.Cache
 
+	// rediscoveredAt is when the provider's metadata was last re-discovered.
+	rediscoveredAt time.Time
+
 	providerCtx       context.Context
 	providerCtxCancel context.CancelFunc
 }
@@ -40,7 +52,9 @@ type jwtAuthBackend struct {
 func backend() *jwtAuthBackend {
 	b := new(jwtAuthBackend)
 	b.providerCtx, b.providerCtxCancel = context.WithCancel(context.Background())
-	b.oidcStates = cache.New(oidcStateTimeout, 1*time.Minute)
+	// Expired states are reaped by the cache's janitor in addition to being
+	// rejected on lookup.
+	b.oidcStates = cache.New(oidcStateTimeout, oidcStateCleanupInterval)
 
 	b.Backend = &framework.Backend{
 		AuthRenew:   b.pathLoginRenew,
@@ -52,6 +66,8 @@ func backend() *jwtAuthBackend {
 				"login",
 				"oidc/auth_url",
 				"oidc/callback",
+				"oidc/logout_url",
+				"oidc/state/*",
 
 				// Uncomment to mount simple UI handler for local development
 				// "ui",
@@ -96,6 +112,7 @@ func (b *jwtAuthBackend) invalidate(ctx context.Context, key string) {
 func (b *jwtAuthBackend) reset() {
 	b.l.Lock()
 	b.provider = nil
+	b.keySet = nil
 	b.cachedConfig = nil
 	b.l.Unlock()
 }
@@ -126,6 +143,108 @@ func (b *jwtAuthBackend) getProvider(ctx context.Context, config *jwtConfig) (*o
 	return provider, nil
 }
 
+// rediscoverProvider replaces the cached provider, if it is still stale, with
+// one created from freshly discovered metadata, and drops the cached key set.
+// Re-discovery happens at most once per minRediscoveryInterval; false is
+// returned if it was skipped or failed.
+func (b *jwtAuthBackend) rediscoverProvider(config *jwtConfig, stale *oidc.Provider) (*oidc.Provider, bool) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	// Another request may have already replaced the stale provider.
+	if b.provider != nil && b.provider != stale {
+		return b.provider, true
+	}
+
+	if time.Since(b.rediscoveredAt) < minRediscoveryInterval {
+		return nil, false
+	}
+	b.rediscoveredAt = time.Now()
+
+	provider, err := b.createProvider(config)
+	if err != nil {
+		b.Logger().Warn("error re-discovering provider metadata", "error", err)
+		return nil, false
+	}
+
+	b.provider = provider
+	b.keySet = nil
+	return provider, true
+}
+
+// getVerifier returns an ID token verifier for the provider. If a JWKS cache
+// TTL is configured, signing keys are fetched through the backend's cached key
+// set rather than the provider's own, which follows the provider's caching
+// headers. A token issuer that only differs from the provider's by a trailing
+// slash is accepted.
+func (b *jwtAuthBackend) getVerifier(config *jwtConfig, provider *oidc.Provider, oidcConfig *oidc.Config, tokenIssuer string) (*oidc.IDTokenVerifier, error) {
+	var metadata struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, errwrap.Wrapf("error parsing provider metadata: {{err}}", err)
+	}
+
+	issuer := metadata.Issuer
+	if issuersMatch(issuer, tokenIssuer) {
+		issuer = tokenIssuer
+	}
+
+	if config.JWKSCacheTTL <= 0 && issuer == metadata.Issuer {
+		return provider.Verifier(oidcConfig), nil
+	}
+
+	keySet, err := b.getKeySet(config, metadata.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	return oidc.NewVerifier(issuer, keySet, oidcConfig), nil
+}
+
+// keyFetchFailed reports whether err, returned when verifying a token, was
+// caused by the JWKS endpoint not being found or its host not being resolved
+// or connected to, the same conditions staleEndpointError treats as a moved
+// endpoint. go-oidc flattens key set errors into strings, so this relies on the
+// messages of both key set implementations and of the net package.
+func keyFetchFailed(err error) bool {
+	msg := err.Error()
+	switch {
+	case !strings.Contains(msg, "fetching keys"):
+		return false
+	case strings.Contains(msg, "404 Not Found"):
+		return true
+	case strings.Contains(strings.ToLower(msg), "timeout"):
+		return false
+	}
+	return strings.Contains(msg, "dial ") || strings.Contains(msg, "no such host")
+}
+
+// getKeySet returns the key set used to verify signatures against keys
+// fetched from jwksURL. The keys are cached for the configured JWKS cache TTL,
+// or according to the server's caching headers if none is set.
+func (b *jwtAuthBackend) getKeySet(config *jwtConfig, jwksURL string) (oidc.KeySet, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.keySet != nil {
+		return b.keySet, nil
+	}
+
+	oidcCtx, err := b.createOIDCContext(b.providerCtx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.JWKSCacheTTL > 0 {
+		b.keySet = newJWKSKeySet(oidcCtx, jwksURL, config.JWKSCacheTTL)
+	} else {
+		b.keySet = oidc.NewRemoteKeySet(oidcCtx, jwksURL)
+	}
+	return b.keySet, nil
+}
+
 const (
 	backendHelp = `
 The JWT backend plugin allows authentication using JWTs (including OIDC).
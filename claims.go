@@ -1,9 +1,16 @@
 package jwtauth
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/helper/strutil"
 
@@ -13,7 +20,9 @@ import (
 
 // getClaim returns a claim value from allClaims given a provided claim string.
 // If this string is a valid JSONPointer, it will be interpreted as such to locate
-// the claim. Otherwise, the claim string will be used directly.
+// the claim; list elements are addressed by index, e.g. "/roles/0". Otherwise,
+// the claim string will be used directly. A claim that cannot be located,
+// including an out of range index, is returned as nil and treated as missing.
 func getClaim(logger log.Logger, allClaims map[string]interface{}, claim string) interface{} {
 	var val interface{}
 	var err error
@@ -28,35 +37,125 @@ func getClaim(logger log.Logger, allClaims map[string]interface{}, claim string)
 		}
 	}
 
-	// The claims unmarshalled by go-oidc don't use UseNumber, so there will
-	// be mismatches if they're coming in as float64 since Vault's config will
-	// be represented as json.Number. If the operator can coerce claims data to
-	// be in string form, there is no problem. Alternatively, we could try to
-	// intelligently convert float64 to json.Number, e.g.:
-	//
-	// switch v := val.(type) {
-	// case float64:
-	// 	val = json.Number(strconv.Itoa(int(v)))
-	// }
-	//
-	// Or we fork and/or PR go-oidc.
+	// The claims unmarshalled by go-oidc don't use UseNumber, so numbers come
+	// in as float64 while Vault's config represents them as json.Number.
+	// Normalize to json.Number so that numeric bound claims can be compared
+	// directly.
+	return normalizeNumbers(val)
+}
+
+// normalizeNumbers converts float64 values, including those held in lists, to
+// json.Number. Other values are returned unchanged.
+func normalizeNumbers(val interface{}) interface{} {
+	switch v := val.(type) {
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'f', -1, 64))
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, elem := range v {
+			normalized[i] = normalizeNumbers(elem)
+		}
+		return normalized
+	}
 
 	return val
 }
 
+// normalizeBoundClaims returns the bound claims in the canonical form they are
+// stored and compared in: numbers become json.Numbers in their shortest form,
+// so 42.0 is stored as 42, and lists become []interface{}, also within
+// objects. Strings, including those that contain numbers, are kept as they are.
+func normalizeBoundClaims(boundClaims map[string]interface{}) map[string]interface{} {
+	if boundClaims == nil {
+		return nil
+	}
+
+	normalized := make(map[string]interface{}, len(boundClaims))
+	for claim, value := range boundClaims {
+		normalized[claim] = normalizeBoundClaimValue(value)
+	}
+	return normalized
+}
+
+func normalizeBoundClaimValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return json.Number(strconv.FormatInt(n, 10))
+		}
+		if f, err := v.Float64(); err == nil {
+			return json.Number(strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	case int:
+		return json.Number(strconv.Itoa(v))
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case float64:
+		return normalizeNumbers(v)
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = elem
+		}
+		return list
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = normalizeBoundClaimValue(elem)
+		}
+		return list
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			object[k] = normalizeBoundClaimValue(elem)
+		}
+		return object
+	}
+
+	return value
+}
+
 // extractMetadata builds a metadata map from a set of claims and claims mappings.
-// The referenced claims must be strings and the claims mappings must be of the structure:
+// The referenced claims must be scalar values (strings, numbers or booleans) or
+// lists of strings, which are joined using delimiter. A source containing
+// {{claim}} placeholders is rendered as a template, and every claim it references
+// must be present. The claims mappings must be of the structure:
 //
 //   {
 //       "/some/claim/pointer": "metadata_key1",
 //       "another_claim": "metadata_key2",
+//       "{{/dept}}-{{/region}}": "metadata_key3",
 //        ...
 //   }
-func extractMetadata(logger log.Logger, allClaims map[string]interface{}, claimMappings map[string]string) (map[string]string, error) {
+func extractMetadata(logger log.Logger, allClaims map[string]interface{}, claimMappings map[string]string, delimiter string) (map[string]string, error) {
 	metadata := make(map[string]string)
 	for source, target := range claimMappings {
+		if isClaimTemplate(source) {
+			value, err := renderClaimTemplate(logger, allClaims, source)
+			if err != nil {
+				return nil, fmt.Errorf("error rendering claim mapping '%s': %s", source, err)
+			}
+
+			metadata[target] = value
+			continue
+		}
+
 		if value := getClaim(logger, allClaims, source); value != nil {
-			strValue, ok := value.(string)
+			if list, ok := value.([]interface{}); ok {
+				strValues := make([]string, 0, len(list))
+				for _, elem := range list {
+					strValue, ok := elem.(string)
+					if !ok {
+						return nil, fmt.Errorf("error converting claim '%s' to string: list value %v is not a string", source, elem)
+					}
+					strValues = append(strValues, strValue)
+				}
+
+				metadata[target] = strings.Join(strValues, delimiter)
+				continue
+			}
+
+			strValue, ok := stringifyClaim(value)
 			if !ok {
 				return nil, fmt.Errorf("error converting claim '%s' to string", source)
 			}
@@ -67,6 +166,167 @@ func extractMetadata(logger log.Logger, allClaims map[string]interface{}, claimM
 	return metadata, nil
 }
 
+// claimTemplateRegex matches the {{claim}} placeholders in a claim template.
+var claimTemplateRegex = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// renderClaimTemplate replaces each {{claim}} placeholder in tmpl with the
+// value of the referenced claim, which may be a JSON pointer. Claims that are
+// missing or that are not scalar values are reported as errors.
+func renderClaimTemplate(logger log.Logger, allClaims map[string]interface{}, tmpl string) (string, error) {
+	var renderErr error
+	result := claimTemplateRegex.ReplaceAllStringFunc(tmpl, func(match string) string {
+		if renderErr != nil {
+			return ""
+		}
+
+		claim := claimTemplateRegex.FindStringSubmatch(match)[1]
+		value := getClaim(logger, allClaims, claim)
+		if value == nil {
+			renderErr = fmt.Errorf("claim %q not found in token", claim)
+			return ""
+		}
+
+		strValue, ok := stringifyClaim(value)
+		if !ok {
+			renderErr = fmt.Errorf("claim %q could not be converted to string", claim)
+			return ""
+		}
+		return strValue
+	})
+
+	return result, renderErr
+}
+
+// isClaimTemplate reports whether s references any claims using {{claim}}
+// placeholders.
+func isClaimTemplate(s string) bool {
+	return claimTemplateRegex.MatchString(s)
+}
+
+// stringifyClaim returns the string representation of a scalar claim value.
+// Values that have no sensible string form, such as maps and arrays, are
+// reported as not convertible.
+func stringifyClaim(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+
+	return "", false
+}
+
+// Claim types that can be given in claim_type_hints.
+const (
+	claimTypeString = "string"
+	claimTypeNumber = "number"
+	claimTypeBool   = "bool"
+	claimTypeArray  = "array"
+)
+
+// applyClaimTypeHints coerces the claims named in hints, which may be JSON
+// pointers, to their hinted type in place, so that providers that encode a
+// claim differently are handled the same. Claims missing from allClaims are
+// skipped; a claim that cannot be coerced is an error.
+func applyClaimTypeHints(allClaims map[string]interface{}, hints map[string]string) error {
+	for claim, claimType := range hints {
+		var value interface{}
+		if strings.HasPrefix(claim, "/") {
+			value, _ = pointerstructure.Get(allClaims, claim)
+		} else {
+			value = allClaims[claim]
+		}
+		if value == nil {
+			continue
+		}
+
+		coerced, ok := coerceClaim(value, claimType)
+		if !ok {
+			return fmt.Errorf("claim %q could not be coerced to %s", claim, claimType)
+		}
+
+		if strings.HasPrefix(claim, "/") {
+			if _, err := pointerstructure.Set(allClaims, claim, coerced); err != nil {
+				return fmt.Errorf("error setting claim %q: %s", claim, err)
+			}
+		} else {
+			allClaims[claim] = coerced
+		}
+	}
+
+	return nil
+}
+
+// coerceClaim converts a claim value to the given claim type. Numbers are
+// returned as float64, the type used for numbers in unmarshalled claims.
+func coerceClaim(value interface{}, claimType string) (interface{}, bool) {
+	switch claimType {
+	case claimTypeString:
+		return stringifyClaim(value)
+
+	case claimTypeNumber:
+		var f float64
+		var err error
+		switch v := value.(type) {
+		case float64:
+			f = v
+		case json.Number:
+			f, err = v.Float64()
+		case string:
+			f, err = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		default:
+			return nil, false
+		}
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, false
+		}
+		return f, true
+
+	case claimTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, true
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			return b, err == nil
+		}
+
+	case claimTypeArray:
+		switch v := value.(type) {
+		case []interface{}:
+			return v, true
+		case map[string]interface{}:
+			return nil, false
+		}
+		return []interface{}{value}, true
+	}
+
+	return nil, false
+}
+
+// issuersMatch reports whether two issuers are the same, ignoring a trailing
+// slash on either, which is a common source of misconfiguration.
+func issuersMatch(expected, actual string) bool {
+	return strings.TrimSuffix(expected, "/") == strings.TrimSuffix(actual, "/")
+}
+
+// validateIssuer checks the token's issuer against the expected one, if set.
+func validateIssuer(expected, actual string) error {
+	if expected != "" && !issuersMatch(expected, actual) {
+		return fmt.Errorf("iss claim does not match bound issuer: got %q, expected %q", actual, expected)
+	}
+	return nil
+}
+
 // validateAudience checks whether any of the audiences in audClaim match those
 // in boundAudiences. If strict is true and there are no bound audiences, then the
 // presence of any audience in the received claim is considered an error.
@@ -88,18 +348,221 @@ func validateAudience(boundAudiences, audClaim []string, strict bool) error {
 }
 
 // validateBoundClaims checks that all of the claim:value requirements in boundClaims are
-// met in allClaims.
-func validateBoundClaims(logger log.Logger, boundClaims, allClaims map[string]interface{}) error {
+// met in allClaims. If a bound value is a list, the claim must match any one of the
+// listed values. If the claim itself is a list, it must contain the bound value.
+// With a boundClaimsType of "glob", bound values may contain leading and/or trailing
+// '*' wildcards.
+func validateBoundClaims(logger log.Logger, boundClaimsType string, boundClaims, allClaims map[string]interface{}) error {
 	for claim, expValue := range boundClaims {
 		actValue := getClaim(logger, allClaims, claim)
 		if actValue == nil {
 			return fmt.Errorf("claim %q is missing", claim)
 		}
 
-		if expValue != actValue {
+		if !matchBoundClaim(expValue, actValue, boundClaimsType) {
 			return fmt.Errorf("claim %q does not match associated bound claim", claim)
 		}
 	}
 
 	return nil
 }
+
+// validateForbiddenClaims checks that none of the claim:value pairs in
+// forbiddenClaims are present in allClaims. Values are matched exactly, with
+// lists handled as for bound claims. Missing claims are not an error.
+func validateForbiddenClaims(logger log.Logger, forbiddenClaims, allClaims map[string]interface{}) error {
+	for claim, value := range forbiddenClaims {
+		actValue := getClaim(logger, allClaims, claim)
+		if actValue == nil {
+			continue
+		}
+
+		if matchBoundClaim(value, actValue, boundClaimsTypeString) {
+			return fmt.Errorf("claim %q matches a forbidden value", claim)
+		}
+	}
+
+	return nil
+}
+
+// validateRequiredClaims checks that each of the required claims is present in
+// allClaims. Empty strings, lists and maps count as missing.
+func validateRequiredClaims(logger log.Logger, requiredClaims []string, allClaims map[string]interface{}) error {
+	for _, claim := range requiredClaims {
+		empty := false
+		switch v := getClaim(logger, allClaims, claim).(type) {
+		case nil:
+			empty = true
+		case string:
+			empty = v == ""
+		case []interface{}:
+			empty = len(v) == 0
+		case map[string]interface{}:
+			empty = len(v) == 0
+		}
+
+		if empty {
+			return fmt.Errorf("required claim %q is missing or empty", claim)
+		}
+	}
+
+	return nil
+}
+
+// boundClaimRegexps caches the compiled regex bound claims by pattern, as roles
+// are read from storage on every login. The patterns come from role configs, so
+// the cache stays small.
+var boundClaimRegexps sync.Map
+
+// boundClaimRegexp returns the compiled regex bound claim for pattern.
+func boundClaimRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := boundClaimRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	boundClaimRegexps.Store(pattern, re)
+	return re, nil
+}
+
+// matchBoundClaim reports whether actValue satisfies the bound value expValue.
+// Regular expressions use Go's RE2 engine, which runs in time linear in the
+// size of the input, so a pattern cannot cause catastrophic backtracking.
+func matchBoundClaim(expValue, actValue interface{}, boundClaimsType string) bool {
+	if expValues, ok := expValue.([]interface{}); ok {
+		for _, v := range expValues {
+			if matchBoundClaim(v, actValue, boundClaimsType) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if actValues, ok := actValue.([]interface{}); ok {
+		for _, v := range actValues {
+			if matchBoundClaim(expValue, v, boundClaimsType) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch boundClaimsType {
+	case boundClaimsTypeGlob:
+		expStr, ok := expValue.(string)
+		if !ok {
+			return false
+		}
+		actStr, ok := actValue.(string)
+		if !ok {
+			return false
+		}
+		return strutil.GlobbedStringsMatch(expStr, actStr)
+
+	case boundClaimsTypeRegex:
+		expStr, ok := expValue.(string)
+		if !ok {
+			return false
+		}
+		actStr, ok := stringifyClaim(actValue)
+		if !ok {
+			return false
+		}
+		// Patterns are validated when the role is written.
+		re, err := boundClaimRegexp(expStr)
+		if err != nil {
+			return false
+		}
+		return re.MatchString(actStr)
+	}
+
+	// Objects must be deeply equal. Numbers within them are compared in their
+	// canonical form.
+	if isObject(expValue) || isObject(actValue) {
+		return reflect.DeepEqual(normalizeBoundClaimValue(expValue), normalizeBoundClaimValue(actValue))
+	}
+
+	// A number matches the same number whether it was written as a number or
+	// as a string, on either side, e.g. a bound value of "42" matches 42.
+	if isNumber(expValue) || isNumber(actValue) {
+		expNum, expOK := numericValue(expValue)
+		actNum, actOK := numericValue(actValue)
+		if expOK && actOK {
+			return expNum == actNum
+		}
+	}
+
+	return expValue == actValue
+}
+
+// isObject reports whether v holds a JSON object.
+func isObject(v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok
+}
+
+// isNumber reports whether v holds a number, as opposed to a string that may
+// contain one.
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case json.Number, float64, int, int64:
+		return true
+	}
+	return false
+}
+
+// numericValue returns the value of a number, or of a string containing one.
+func numericValue(v interface{}) (float64, bool) {
+	var s string
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		s = n.String()
+	case string:
+		s = strings.TrimSpace(n)
+	default:
+		return 0, false
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
+
+// claimTime converts a NumericDate claim value, such as 'exp', to a time. The
+// value may have been decoded from JSON as a float64 or json.Number, and may
+// have a fractional part, which is truncated.
+func claimTime(v interface{}) (time.Time, bool) {
+	var secs int64
+	switch t := v.(type) {
+	case float64:
+		secs = int64(t)
+	case int64:
+		secs = t
+	case int:
+		secs = int64(t)
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			secs = n
+			break
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		secs = int64(f)
+	default:
+		return time.Time{}, false
+	}
+
+	return time.Unix(secs, 0), true
+}
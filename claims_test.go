@@ -12,6 +12,7 @@ func TestGetClaim(t *testing.T) {
 	data := `{
 		"a": 42,
 		"b": "bar",
+		"h": 3.14,
 		"c": {
 			"d": 95,
 			"e": [
@@ -33,11 +34,15 @@ func TestGetClaim(t *testing.T) {
 		claim string
 		value interface{}
 	}{
-		{"a", float64(42)},
-		{"/a", float64(42)},
+		{"a", json.Number("42")},
+		{"/a", json.Number("42")},
 		{"b", "bar"},
-		{"/c/d", float64(95)},
+		{"h", json.Number("3.14")},
+		{"/c/d", json.Number("95")},
 		{"/c/e/1", "cat"},
+		{"/c/e/3", nil},
+		{"/c/e/-1", nil},
+		{"/c/e/x", nil},
 		{"/c/f/g", "zebra"},
 		{"nope", nil},
 		{"/c/f/h", nil},
@@ -81,6 +86,25 @@ func TestExtractMetadata(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"array index",
+			map[string]interface{}{
+				"emails": []interface{}{"bob@example.com", "bobby@example.com"},
+				"teams": []interface{}{
+					map[string]interface{}{"name": "ops"},
+				},
+			},
+			map[string]string{
+				"/emails/1":     "val1",
+				"/teams/0/name": "val2",
+				"/emails/2":     "val3",
+			},
+			map[string]string{
+				"val1": "bobby@example.com",
+				"val2": "ops",
+			},
+			false,
+		},
 		{
 			"partial match",
 			map[string]interface{}{
@@ -128,9 +152,114 @@ func TestExtractMetadata(t *testing.T) {
 			false,
 		},
 		{
-			"error: non-string data",
+			"scalar data",
+			map[string]interface{}{
+				"float":  float64(42.5),
+				"number": json.Number("1234"),
+				"int":    42,
+				"bool":   true,
+			},
+			map[string]string{
+				"float":  "val1",
+				"number": "val2",
+				"int":    "val3",
+				"bool":   "val4",
+			},
+			map[string]string{
+				"val1": "42.5",
+				"val2": "1234",
+				"val3": "42",
+				"val4": "true",
+			},
+			false,
+		},
+		{
+			"integral float data",
+			map[string]interface{}{
+				"data1": float64(1550000000),
+			},
+			map[string]string{
+				"data1": "val1",
+			},
+			map[string]string{
+				"val1": "1550000000",
+			},
+			false,
+		},
+		{
+			"error: map data",
+			map[string]interface{}{
+				"data1": map[string]interface{}{
+					"child": "bar",
+				},
+			},
+			map[string]string{
+				"data1": "val1",
+			},
+			nil,
+			true,
+		},
+		{
+			"string array data",
+			map[string]interface{}{
+				"data1": []interface{}{"foo", "bar"},
+				"data2": []interface{}{},
+			},
+			map[string]string{
+				"data1": "val1",
+				"data2": "val2",
+			},
+			map[string]string{
+				"val1": "foo,bar",
+				"val2": "",
+			},
+			false,
+		},
+		{
+			"error: mixed array data",
 			map[string]interface{}{
-				"data1": 42,
+				"data1": []interface{}{"foo", 42, "bar"},
+			},
+			map[string]string{
+				"data1": "val1",
+			},
+			nil,
+			true,
+		},
+		{
+			"templated data",
+			map[string]interface{}{
+				"data1": "foo",
+				"data2": map[string]interface{}{
+					"dept":   "eng",
+					"region": "emea",
+				},
+			},
+			map[string]string{
+				"data1":                             "val1",
+				"{{/data2/dept}}-{{/data2/region}}": "val2",
+			},
+			map[string]string{
+				"val1": "foo",
+				"val2": "eng-emea",
+			},
+			false,
+		},
+		{
+			"error: templated data with missing claim",
+			map[string]interface{}{
+				"data1": "foo",
+			},
+			map[string]string{
+				"{{data1}}-{{data2}}": "val1",
+			},
+			nil,
+			true,
+		},
+		{
+			"error: nested array data",
+			map[string]interface{}{
+				"data1": []interface{}{"foo", []interface{}{"bar"}},
 			},
 			map[string]string{
 				"data1": "val1",
@@ -141,7 +270,7 @@ func TestExtractMetadata(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		actual, err := extractMetadata(hclog.NewNullLogger(), test.allClaims, test.claimMappings)
+		actual, err := extractMetadata(hclog.NewNullLogger(), test.allClaims, test.claimMappings, ",")
 		if (err != nil) != test.errExpected {
 			t.Fatalf("case '%s': expected error: %t, actual: %v", test.testCase, test.errExpected, err)
 		}
@@ -151,6 +280,58 @@ func TestExtractMetadata(t *testing.T) {
 	}
 }
 
+func TestExtractMetadata_Delimiter(t *testing.T) {
+	allClaims := map[string]interface{}{
+		"roles": []interface{}{"admin", "dev"},
+		"team":  "infra",
+	}
+	claimMappings := map[string]string{
+		"roles": "roles",
+		"team":  "team",
+	}
+
+	actual, err := extractMetadata(hclog.NewNullLogger(), allClaims, claimMappings, " | ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"roles": "admin | dev",
+		"team":  "infra",
+	}
+	if diff := deep.Equal(actual, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestValidateIssuer(t *testing.T) {
+	tests := []struct {
+		expected    string
+		actual      string
+		errExpected bool
+	}{
+		{"", "https://idp.example.com", false},
+		{"https://idp.example.com", "https://idp.example.com", false},
+		{"https://idp.example.com/", "https://idp.example.com", false},
+		{"https://idp.example.com", "https://idp.example.com/", false},
+		{"https://idp.example.com/", "https://idp.example.com/", false},
+		{"https://idp.example.com", "https://idp.example.com/tenant", true},
+		{"https://idp.example.com", "", true},
+	}
+
+	for _, test := range tests {
+		err := validateIssuer(test.expected, test.actual)
+		if (err != nil) != test.errExpected {
+			t.Fatalf("expected %q, actual %q: expected error: %t, got: %v", test.expected, test.actual, test.errExpected, err)
+		}
+	}
+
+	err := validateIssuer("https://idp.example.com", "https://other.example.com")
+	if err == nil || err.Error() != `iss claim does not match bound issuer: got "https://other.example.com", expected "https://idp.example.com"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 func TestValidateAudience(t *testing.T) {
 	tests := []struct {
 		boundAudiences []string
@@ -180,10 +361,11 @@ func TestValidateAudience(t *testing.T) {
 
 func TestValidateBoundClaims(t *testing.T) {
 	tests := []struct {
-		name        string
-		boundClaims map[string]interface{}
-		allClaims   map[string]interface{}
-		errExpected bool
+		name            string
+		boundClaimsType string
+		boundClaims     map[string]interface{}
+		allClaims       map[string]interface{}
+		errExpected     bool
 	}{
 		{
 			name: "valid",
@@ -197,6 +379,110 @@ func TestValidateBoundClaims(t *testing.T) {
 			},
 			errExpected: false,
 		},
+		{
+			name: "valid - numeric claims",
+			boundClaims: map[string]interface{}{
+				"sk":    json.Number("42"),
+				"ratio": json.Number("0.5"),
+				"list":  json.Number("7"),
+			},
+			allClaims: map[string]interface{}{
+				"sk":    float64(42),
+				"ratio": float64(0.5),
+				"list":  []interface{}{float64(6), float64(7)},
+			},
+			errExpected: false,
+		},
+		{
+			name: "valid - quoted and unquoted numeric bound claims",
+			boundClaims: map[string]interface{}{
+				"sk":      "42",
+				"count":   json.Number("3.0"),
+				"version": json.Number("2"),
+			},
+			allClaims: map[string]interface{}{
+				"sk":      float64(42),
+				"count":   float64(3),
+				"version": "2",
+			},
+			errExpected: false,
+		},
+		{
+			name: "numeric strings only match as strings",
+			boundClaims: map[string]interface{}{
+				"sk": "042",
+			},
+			allClaims: map[string]interface{}{
+				"sk": "42",
+			},
+			errExpected: true,
+		},
+		{
+			name: "valid - nested object",
+			boundClaims: map[string]interface{}{
+				"org": map[string]interface{}{
+					"name": "eng",
+					"tier": json.Number("2"),
+				},
+			},
+			allClaims: map[string]interface{}{
+				"org": map[string]interface{}{
+					"tier": float64(2),
+					"name": "eng",
+				},
+			},
+			errExpected: false,
+		},
+		{
+			name: "valid - nested object in list",
+			boundClaims: map[string]interface{}{
+				"orgs": map[string]interface{}{"name": "eng"},
+			},
+			allClaims: map[string]interface{}{
+				"orgs": []interface{}{
+					map[string]interface{}{"name": "ops"},
+					map[string]interface{}{"name": "eng"},
+				},
+			},
+			errExpected: false,
+		},
+		{
+			name: "mismatched nested object",
+			boundClaims: map[string]interface{}{
+				"org": map[string]interface{}{
+					"name": "eng",
+				},
+			},
+			allClaims: map[string]interface{}{
+				"org": map[string]interface{}{
+					"name": "eng",
+					"tier": float64(2),
+				},
+			},
+			errExpected: true,
+		},
+		{
+			name: "object bound to scalar claim",
+			boundClaims: map[string]interface{}{
+				"org": map[string]interface{}{
+					"name": "eng",
+				},
+			},
+			allClaims: map[string]interface{}{
+				"org": "eng",
+			},
+			errExpected: true,
+		},
+		{
+			name: "mismatched numeric claim",
+			boundClaims: map[string]interface{}{
+				"sk": json.Number("42"),
+			},
+			allClaims: map[string]interface{}{
+				"sk": float64(42.5),
+			},
+			errExpected: true,
+		},
 		{
 			name: "valid - extra data",
 			boundClaims: map[string]interface{}{
@@ -275,10 +561,457 @@ func TestValidateBoundClaims(t *testing.T) {
 			},
 			errExpected: true,
 		},
+		{
+			name: "valid - scalar in list claim",
+			boundClaims: map[string]interface{}{
+				"department": "eng",
+			},
+			allClaims: map[string]interface{}{
+				"department": []interface{}{"eng", "sre"},
+			},
+			errExpected: false,
+		},
+		{
+			name: "invalid - scalar not in list claim",
+			boundClaims: map[string]interface{}{
+				"department": "sales",
+			},
+			allClaims: map[string]interface{}{
+				"department": []interface{}{"eng", "sre"},
+			},
+			errExpected: true,
+		},
+		{
+			name: "valid - scalar claim in bound list",
+			boundClaims: map[string]interface{}{
+				"department": []interface{}{"eng", "sre"},
+			},
+			allClaims: map[string]interface{}{
+				"department": "sre",
+			},
+			errExpected: false,
+		},
+		{
+			name: "invalid - scalar claim not in bound list",
+			boundClaims: map[string]interface{}{
+				"department": []interface{}{"eng", "sre"},
+			},
+			allClaims: map[string]interface{}{
+				"department": "sales",
+			},
+			errExpected: true,
+		},
+		{
+			name: "valid - list claim intersects bound list",
+			boundClaims: map[string]interface{}{
+				"department": []interface{}{"sales", "sre"},
+			},
+			allClaims: map[string]interface{}{
+				"department": []interface{}{"eng", "sre"},
+			},
+			errExpected: false,
+		},
+		{
+			name: "invalid - list claim disjoint from bound list",
+			boundClaims: map[string]interface{}{
+				"department": []interface{}{"sales", "support"},
+			},
+			allClaims: map[string]interface{}{
+				"department": []interface{}{"eng", "sre"},
+			},
+			errExpected: true,
+		},
+		{
+			name:            "valid - glob suffix",
+			boundClaimsType: boundClaimsTypeGlob,
+			boundClaims: map[string]interface{}{
+				"email": "*@example.com",
+			},
+			allClaims: map[string]interface{}{
+				"email": "bob@example.com",
+			},
+			errExpected: false,
+		},
+		{
+			name:            "invalid - glob suffix mismatch",
+			boundClaimsType: boundClaimsTypeGlob,
+			boundClaims: map[string]interface{}{
+				"email": "*@example.com",
+			},
+			allClaims: map[string]interface{}{
+				"email": "bob@example.com.evil.io",
+			},
+			errExpected: true,
+		},
+		{
+			name:            "valid - glob in bound list against list claim",
+			boundClaimsType: boundClaimsTypeGlob,
+			boundClaims: map[string]interface{}{
+				"groups": []interface{}{"admin-*", "*-ops"},
+			},
+			allClaims: map[string]interface{}{
+				"groups": []interface{}{"users", "team-ops"},
+			},
+			errExpected: false,
+		},
+		{
+			name:            "invalid - glob against non-string claim",
+			boundClaimsType: boundClaimsTypeGlob,
+			boundClaims: map[string]interface{}{
+				"level": "4*",
+			},
+			allClaims: map[string]interface{}{
+				"level": float64(42),
+			},
+			errExpected: true,
+		},
+		{
+			name:            "invalid - wildcard is literal in string mode",
+			boundClaimsType: boundClaimsTypeString,
+			boundClaims: map[string]interface{}{
+				"email": "*@example.com",
+			},
+			allClaims: map[string]interface{}{
+				"email": "bob@example.com",
+			},
+			errExpected: true,
+		},
+		{
+			name:            "valid - literal wildcard in string mode",
+			boundClaimsType: boundClaimsTypeString,
+			boundClaims: map[string]interface{}{
+				"email": "*@example.com",
+			},
+			allClaims: map[string]interface{}{
+				"email": "*@example.com",
+			},
+			errExpected: false,
+		},
+		{
+			name:            "valid - regex match",
+			boundClaimsType: boundClaimsTypeRegex,
+			boundClaims: map[string]interface{}{
+				"upn": `^[a-z]+\.[a-z]+@corp\.example\.com$`,
+			},
+			allClaims: map[string]interface{}{
+				"upn": "jane.doe@corp.example.com",
+			},
+			errExpected: false,
+		},
+		{
+			name:            "invalid - regex mismatch",
+			boundClaimsType: boundClaimsTypeRegex,
+			boundClaims: map[string]interface{}{
+				"upn": `^[a-z]+\.[a-z]+@corp\.example\.com$`,
+			},
+			allClaims: map[string]interface{}{
+				"upn": "jane.doe@corp.example.com.evil.com",
+			},
+			errExpected: true,
+		},
+		{
+			name:            "valid - regex list against list claim",
+			boundClaimsType: boundClaimsTypeRegex,
+			boundClaims: map[string]interface{}{
+				"groups": []interface{}{"^admin-", "-ops$"},
+			},
+			allClaims: map[string]interface{}{
+				"groups": []interface{}{"users", "team-ops"},
+			},
+			errExpected: false,
+		},
+		{
+			name:            "valid - regex against numeric claim",
+			boundClaimsType: boundClaimsTypeRegex,
+			boundClaims: map[string]interface{}{
+				"level": "^4[0-9]$",
+			},
+			allClaims: map[string]interface{}{
+				"level": float64(42),
+			},
+			errExpected: false,
+		},
+		{
+			name:            "invalid - regex against map claim",
+			boundClaimsType: boundClaimsTypeRegex,
+			boundClaims: map[string]interface{}{
+				"org": ".*",
+			},
+			allClaims: map[string]interface{}{
+				"org": map[string]interface{}{"name": "acme"},
+			},
+			errExpected: true,
+		},
+		{
+			name: "valid - array index pointer",
+			boundClaims: map[string]interface{}{
+				"/roles/0":        "admin",
+				"/teams/1/name":   "ops",
+				"/teams/1/groups": "on-call",
+			},
+			allClaims: map[string]interface{}{
+				"roles": []interface{}{"admin", "dev"},
+				"teams": []interface{}{
+					map[string]interface{}{"name": "dev"},
+					map[string]interface{}{"name": "ops", "groups": []interface{}{"on-call", "sre"}},
+				},
+			},
+			errExpected: false,
+		},
+		{
+			name: "invalid - array index pointer mismatch",
+			boundClaims: map[string]interface{}{
+				"/roles/1": "admin",
+			},
+			allClaims: map[string]interface{}{
+				"roles": []interface{}{"admin", "dev"},
+			},
+			errExpected: true,
+		},
+		{
+			name: "invalid - array index pointer out of range",
+			boundClaims: map[string]interface{}{
+				"/roles/2": "admin",
+			},
+			allClaims: map[string]interface{}{
+				"roles": []interface{}{"admin", "dev"},
+			},
+			errExpected: true,
+		},
+		{
+			name:            "invalid - array index pointer out of range with glob",
+			boundClaimsType: boundClaimsTypeGlob,
+			boundClaims: map[string]interface{}{
+				"/roles/5": "*",
+			},
+			allClaims: map[string]interface{}{
+				"roles": []interface{}{"admin", "dev"},
+			},
+			errExpected: true,
+		},
 	}
 	for _, tt := range tests {
-		if err := validateBoundClaims(hclog.NewNullLogger(), tt.boundClaims, tt.allClaims); (err != nil) != tt.errExpected {
+		if err := validateBoundClaims(hclog.NewNullLogger(), tt.boundClaimsType, tt.boundClaims, tt.allClaims); (err != nil) != tt.errExpected {
 			t.Errorf("validateBoundClaims(%s) error = %v, wantErr %v", tt.name, err, tt.errExpected)
 		}
 	}
 }
+
+func TestClaimTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected int64
+		ok       bool
+	}{
+		{"float64", float64(1700000000), 1700000000, true},
+		{"int64", int64(1700000000), 1700000000, true},
+		{"json.Number", json.Number("1700000000"), 1700000000, true},
+		{"fractional float64", 1700000000.5, 1700000000, true},
+		{"fractional json.Number", json.Number("1700000000.5"), 1700000000, true},
+		{"exponent json.Number", json.Number("1.7e9"), 1700000000, true},
+		{"invalid json.Number", json.Number("soon"), 0, false},
+		{"string", "1700000000", 0, false},
+		{"missing", nil, 0, false},
+	}
+
+	for _, test := range tests {
+		actual, ok := claimTime(test.value)
+		if ok != test.ok {
+			t.Fatalf("%s: expected ok %t, got %t", test.name, test.ok, ok)
+		}
+		if ok && actual.Unix() != test.expected {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.expected, actual.Unix())
+		}
+	}
+}
+
+func TestBoundClaimRegexp(t *testing.T) {
+	re, err := boundClaimRegexp("^team-[0-9]+$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := boundClaimRegexp("^team-[0-9]+$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re != cached {
+		t.Fatal("expected the compiled pattern to be reused")
+	}
+
+	if _, err := boundClaimRegexp("team-[0-9"); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+}
+
+func TestValidateRequiredClaims(t *testing.T) {
+	allClaims := map[string]interface{}{
+		"groups":       []interface{}{"a"},
+		"email":        "bob@example.com",
+		"verified":     false,
+		"level":        float64(0),
+		"empty_string": "",
+		"empty_list":   []interface{}{},
+		"empty_map":    map[string]interface{}{},
+		"org": map[string]interface{}{
+			"name": "acme",
+		},
+	}
+
+	tests := []struct {
+		required    []string
+		errExpected bool
+	}{
+		{nil, false},
+		{[]string{"groups", "email", "/org/name"}, false},
+		{[]string{"verified", "level"}, false},
+		{[]string{"email", "missing"}, true},
+		{[]string{"/org/missing"}, true},
+		{[]string{"empty_string"}, true},
+		{[]string{"empty_list"}, true},
+		{[]string{"empty_map"}, true},
+	}
+
+	for _, test := range tests {
+		err := validateRequiredClaims(hclog.NewNullLogger(), test.required, allClaims)
+		if (err != nil) != test.errExpected {
+			t.Fatalf("required %v: expected error: %t, actual: %v", test.required, test.errExpected, err)
+		}
+	}
+}
+
+func TestValidateForbiddenClaims(t *testing.T) {
+	allClaims := map[string]interface{}{
+		"account_status": "active",
+		"groups":         []interface{}{"a", "b"},
+		"level":          float64(3),
+		"org": map[string]interface{}{
+			"flagged": true,
+		},
+	}
+
+	tests := []struct {
+		forbidden   map[string]interface{}
+		errExpected bool
+	}{
+		{nil, false},
+		{map[string]interface{}{"account_status": "suspended"}, false},
+		{map[string]interface{}{"account_status": "active"}, true},
+		{map[string]interface{}{"account_status": []interface{}{"suspended", "active"}}, true},
+		{map[string]interface{}{"groups": "c"}, false},
+		{map[string]interface{}{"groups": "b"}, true},
+		{map[string]interface{}{"level": json.Number("3")}, true},
+		{map[string]interface{}{"/org/flagged": true}, true},
+		{map[string]interface{}{"/org/flagged": false}, false},
+		{map[string]interface{}{"missing": "x"}, false},
+	}
+
+	for _, test := range tests {
+		err := validateForbiddenClaims(hclog.NewNullLogger(), test.forbidden, allClaims)
+		if (err != nil) != test.errExpected {
+			t.Fatalf("forbidden %v: expected error: %t, actual: %v", test.forbidden, test.errExpected, err)
+		}
+	}
+}
+
+func TestRenderClaimTemplate(t *testing.T) {
+	logger := hclog.NewNullLogger()
+
+	claims := map[string]interface{}{
+		"sub":       "bob",
+		"tenant_id": "acme",
+		"level":     json.Number("3"),
+		"groups":    []interface{}{"a", "b"},
+		"org": map[string]interface{}{
+			"region": "emea",
+		},
+	}
+
+	tests := []struct {
+		tmpl     string
+		expected string
+		errMsg   string
+	}{
+		{"{{sub}}@{{tenant_id}}", "bob@acme", ""},
+		{"{{ sub }}-{{/org/region}}-{{level}}", "bob-emea-3", ""},
+		{"{{sub}}@{{missing}}", "", `claim "missing" not found in token`},
+		{"{{groups}}", "", `claim "groups" could not be converted to string`},
+	}
+
+	for _, test := range tests {
+		actual, err := renderClaimTemplate(logger, claims, test.tmpl)
+		if test.errMsg != "" {
+			if err == nil || err.Error() != test.errMsg {
+				t.Fatalf("template %q: expected error %q, got: %v", test.tmpl, test.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("template %q: unexpected error: %v", test.tmpl, err)
+		}
+		if actual != test.expected {
+			t.Fatalf("template %q: expected %q, got %q", test.tmpl, test.expected, actual)
+		}
+	}
+}
+
+func TestApplyClaimTypeHints(t *testing.T) {
+	tests := []struct {
+		name        string
+		claimType   string
+		value       interface{}
+		expected    interface{}
+		errExpected bool
+	}{
+		{"number to string", claimTypeString, float64(1234567), "1234567", false},
+		{"bool to string", claimTypeString, true, "true", false},
+		{"list to string", claimTypeString, []interface{}{"a"}, nil, true},
+		{"string to number", claimTypeNumber, " 42.5 ", float64(42.5), false},
+		{"json.Number to number", claimTypeNumber, json.Number("7"), float64(7), false},
+		{"invalid number", claimTypeNumber, "forty-two", nil, true},
+		{"NaN", claimTypeNumber, "NaN", nil, true},
+		{"string to bool", claimTypeBool, "true", true, false},
+		{"invalid bool", claimTypeBool, "yes please", nil, true},
+		{"number to bool", claimTypeBool, float64(1), nil, true},
+		{"scalar to array", claimTypeArray, "admin", []interface{}{"admin"}, false},
+		{"array unchanged", claimTypeArray, []interface{}{"a", "b"}, []interface{}{"a", "b"}, false},
+		{"map to array", claimTypeArray, map[string]interface{}{"a": "b"}, nil, true},
+	}
+
+	for _, test := range tests {
+		// the hint applies to a top-level claim and a JSON pointer alike
+		for _, claim := range []string{"claim", "/nested/claim"} {
+			allClaims := map[string]interface{}{
+				"claim": test.value,
+				"nested": map[string]interface{}{
+					"claim": test.value,
+				},
+			}
+
+			err := applyClaimTypeHints(allClaims, map[string]string{claim: test.claimType})
+			if (err != nil) != test.errExpected {
+				t.Fatalf("case %q (%s): unexpected error: %v", test.name, claim, err)
+			}
+			if err != nil {
+				continue
+			}
+
+			value := allClaims["claim"]
+			if claim == "/nested/claim" {
+				value = allClaims["nested"].(map[string]interface{})["claim"]
+			}
+			if diff := deep.Equal(value, test.expected); diff != nil {
+				t.Fatalf("case %q (%s): %v", test.name, claim, diff)
+			}
+		}
+	}
+
+	// unlisted and missing claims are left alone
+	allClaims := map[string]interface{}{"sk": float64(42)}
+	if err := applyClaimTypeHints(allClaims, map[string]string{"missing": claimTypeString, "/nested/missing": claimTypeNumber}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(allClaims, map[string]interface{}{"sk": float64(42)}); diff != nil {
+		t.Fatal(diff)
+	}
+}
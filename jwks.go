@@ -0,0 +1,170 @@
+package jwtauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// jwksMinRefreshInterval is the minimum time between refreshes triggered by an
+// unknown key ID, so that tokens with made-up key IDs cannot be used to flood
+// the provider's JWKS endpoint.
+const jwksMinRefreshInterval = 10 * time.Second
+
+// jwksKeySet is an oidc.KeySet that caches the provider's signing keys for a
+// fixed duration. The keys are also refreshed, at most once per verification
+// and once per jwksMinRefreshInterval, when a token is signed with a key ID that
+// is not in the cache so that key rotations are picked up without waiting for
+// the cache to expire.
+type jwksKeySet struct {
+	jwksURL string
+	ctx     context.Context
+	ttl     time.Duration
+	now     func() time.Time
+
+	// refreshMu serializes fetches so that concurrent verifications needing a
+	// refresh share a single request. mu only guards the cached keys and is
+	// never held across a fetch.
+	refreshMu sync.Mutex
+
+	mu         sync.Mutex
+	keys       []jose.JSONWebKey
+	fetchedAt  time.Time
+	generation uint64
+}
+
+func newJWKSKeySet(ctx context.Context, jwksURL string, ttl time.Duration) *jwksKeySet {
+	return &jwksKeySet{
+		jwksURL: jwksURL,
+		ctx:     ctx,
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// VerifySignature implements oidc.KeySet.
+func (k *jwksKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, errwrap.Wrapf("malformed jwt: {{err}}", err)
+	}
+
+	// The key ID is taken from the first signature, as go-oidc does.
+	keyID := ""
+	for _, sig := range jws.Signatures {
+		keyID = sig.Header.KeyID
+		break
+	}
+
+	k.mu.Lock()
+	cached, fetchedAt, generation := k.keys, k.fetchedAt, k.generation
+	k.mu.Unlock()
+
+	refreshed := false
+	if cached == nil || k.now().Sub(fetchedAt) >= k.ttl {
+		if cached, err = k.refresh(generation); err != nil {
+			return nil, err
+		}
+		refreshed = true
+	}
+
+	keys := matchingKeys(cached, keyID)
+	if len(keys) == 0 && !refreshed && k.now().Sub(fetchedAt) >= jwksMinRefreshInterval {
+		if cached, err = k.refresh(generation); err != nil {
+			return nil, err
+		}
+		keys = matchingKeys(cached, keyID)
+	}
+
+	for _, key := range keys {
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, nil
+		}
+	}
+
+	return nil, errors.New("failed to verify id token signature")
+}
+
+// matchingKeys returns the keys that may have signed a token with the given key
+// ID. A token without a key ID may have been signed by any key.
+func matchingKeys(keys []jose.JSONWebKey, keyID string) []jose.JSONWebKey {
+	var matching []jose.JSONWebKey
+	for _, key := range keys {
+		if keyID == "" || key.KeyID == keyID {
+			matching = append(matching, key)
+		}
+	}
+	return matching
+}
+
+// refresh fetches the key set and swaps it into the cache. If the cache has
+// already moved past the given generation, because a concurrent verification
+// refreshed it in the meantime, the cached keys are returned without fetching.
+func (k *jwksKeySet) refresh(generation uint64) ([]jose.JSONWebKey, error) {
+	k.refreshMu.Lock()
+	defer k.refreshMu.Unlock()
+
+	k.mu.Lock()
+	if k.generation != generation {
+		keys := k.keys
+		k.mu.Unlock()
+		return keys, nil
+	}
+	k.mu.Unlock()
+
+	keys, err := k.fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.fetchedAt = k.now()
+	k.generation++
+	k.mu.Unlock()
+
+	return keys, nil
+}
+
+// fetch retrieves the key set from the provider without touching the cache.
+func (k *jwksKeySet) fetch() ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequest("GET", k.jwksURL, nil)
+	if err != nil {
+		return nil, errwrap.Wrapf("error creating JWKS request: {{err}}", err)
+	}
+
+	client := http.DefaultClient
+	if c, ok := k.ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		client = c
+	}
+
+	resp, err := client.Do(req.WithContext(k.ctx))
+	if err != nil {
+		return nil, errwrap.Wrapf("error fetching keys: {{err}}", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading keys: {{err}}", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching keys: %s: %s", resp.Status, body)
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, errwrap.Wrapf("error decoding keys: {{err}}", err)
+	}
+
+	return keySet.Keys, nil
+}
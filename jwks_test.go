@@ -0,0 +1,161 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// jwksServer serves the test public key at /certs under a configurable set of
+// key IDs and counts the requests it receives.
+type jwksServer struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu       sync.Mutex
+	keyIDs   []string
+	requests int
+}
+
+func newJWKSServer(t *testing.T, keyIDs ...string) *jwksServer {
+	s := &jwksServer{t: t, keyIDs: keyIDs}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	if r.URL.Path != "/certs" {
+		s.t.Errorf("unexpected path: %q", r.URL.Path)
+		w.WriteHeader(404)
+		return
+	}
+
+	block, _ := pem.Decode([]byte(ecdsaPubKey))
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	var jwks jose.JSONWebKeySet
+	for _, keyID := range s.keyIDs {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{Key: pub, KeyID: keyID})
+	}
+	data, _ := json.Marshal(jwks)
+	w.Write(data)
+}
+
+func (s *jwksServer) setKeyIDs(keyIDs ...string) {
+	s.mu.Lock()
+	s.keyIDs = keyIDs
+	s.mu.Unlock()
+}
+
+func (s *jwksServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func getTestJWTWithKeyID(t *testing.T, keyID string) string {
+	t.Helper()
+
+	_, key := getTestJWT(t, ecdsaPrivKey, jwt.Claims{}, struct{}{})
+	sig, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       jose.JSONWebKey{Key: key, KeyID: keyID},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := jwt.Signed(sig).Claims(jwt.Claims{Subject: "test"}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestJWKSKeySet(t *testing.T) {
+	s := newJWKSServer(t, "key-1")
+	defer s.server.Close()
+
+	now := time.Now()
+	keySet := newJWKSKeySet(context.Background(), s.server.URL+"/certs", time.Hour)
+	keySet.now = func() time.Time { return now }
+
+	verify := func(keyID string, expectedRequests int, expectErr bool) {
+		t.Helper()
+		_, err := keySet.VerifySignature(context.Background(), getTestJWTWithKeyID(t, keyID))
+		if (err != nil) != expectErr {
+			t.Fatalf("unexpected error for key ID %q: %v", keyID, err)
+		}
+		if count := s.requestCount(); count != expectedRequests {
+			t.Fatalf("expected %d JWKS requests, got %d", expectedRequests, count)
+		}
+	}
+
+	// The keys are fetched on first use and cached afterwards.
+	verify("key-1", 1, false)
+	verify("key-1", 1, false)
+
+	// An unknown key ID does not trigger a refresh until the minimum refresh
+	// interval has passed, and then triggers exactly one.
+	s.setKeyIDs("key-1", "key-2")
+	verify("key-2", 1, true)
+	now = now.Add(jwksMinRefreshInterval)
+	verify("key-2", 2, false)
+	verify("key-2", 2, false)
+	verify("key-3", 2, true)
+	now = now.Add(jwksMinRefreshInterval)
+	verify("key-3", 3, true)
+
+	// The keys are refreshed once the TTL has passed.
+	now = now.Add(time.Hour)
+	verify("key-1", 4, false)
+	verify("key-1", 4, false)
+}
+
+func TestJWKSKeySet_ConcurrentRefresh(t *testing.T) {
+	s := newJWKSServer(t, "key-1")
+	defer s.server.Close()
+
+	keySet := newJWKSKeySet(context.Background(), s.server.URL+"/certs", time.Hour)
+	if _, err := keySet.VerifySignature(context.Background(), getTestJWTWithKeyID(t, "key-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent verifications with an unknown key ID share a single refresh.
+	now := time.Now().Add(jwksMinRefreshInterval)
+	keySet.now = func() time.Time { return now }
+	s.setKeyIDs("key-1", "key-2")
+
+	token := getTestJWTWithKeyID(t, "key-2")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := keySet.VerifySignature(context.Background(), token); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := s.requestCount(); count != 2 {
+		t.Fatalf("expected 2 JWKS requests, got %d", count)
+	}
+}
@@ -1,21 +1,51 @@
 package jwtauth
 
 import (
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"context"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/hashicorp/errwrap"
 	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	"github.com/hashicorp/vault/helper/certutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// Methods the client can use to authenticate to the token endpoint, as named
+// by OpenID Connect Core, section 9.
+const (
+	clientAuthMethodBasic         = "client_secret_basic"
+	clientAuthMethodPost          = "client_secret_post"
+	clientAuthMethodPrivateKeyJWT = "private_key_jwt"
+	clientAuthMethodNone          = "none"
+)
+
+// defaultClockSkewLeeway is the default leeway allowed when checking the time
+// claims of a token.
+const defaultClockSkewLeeway = 60 * time.Second
+
+// Defaults for requests to the OIDC provider, which also apply to configs
+// stored before the settings were added.
+const (
+	defaultOIDCRequestTimeout = 30 * time.Second
+	defaultOIDCMaxRetries     = 2
 )
 
 func pathConfig(b *jwtAuthBackend) *framework.Path {
@@ -24,37 +54,126 @@ func pathConfig(b *jwtAuthBackend) *framework.Path {
 		Fields: map[string]*framework.FieldSchema{
 			"oidc_discovery_url": {
 				Type:        framework.TypeString,
-				Description: `OIDC Discovery URL, without any .well-known component (base path). Cannot be used with "jwt_validation_pubkeys".`,
+				Description: `OIDC Discovery URL, without any .well-known component (base path). Cannot be used with "jwks_url" or "jwt_validation_pubkeys".`,
 			},
 			"oidc_discovery_ca_pem": {
 				Type:        framework.TypeString,
 				Description: "The CA certificate or chain of certificates, in PEM format, to use to validate conections to the OIDC Discovery URL. If not set, system certificates are used.",
 			},
+			"jwks_url": {
+				Type:        framework.TypeString,
+				Description: `JWKS URL to use to authenticate signatures. Cannot be used with "oidc_discovery_url" or "jwt_validation_pubkeys".`,
+			},
+			"jwks_ca_pem": {
+				Type:        framework.TypeString,
+				Description: "The CA certificate or chain of certificates, in PEM format, to use to validate connections to the JWKS URL. If not set, system certificates are used.",
+			},
 			"oidc_client_id": {
 				Type:        framework.TypeString,
 				Description: "The OAuth Client ID configured with your OIDC provider.",
 			},
 			"oidc_client_secret": {
 				Type:             framework.TypeString,
-				Description:      "The OAuth Client Secret configured with your OIDC provider.",
+				Description:      "The OAuth Client Secret configured with your OIDC provider. It is never returned when reading the config; oidc_client_secret_set reports whether it is set.",
 				DisplaySensitive: true,
 			},
+			"oidc_client_auth_method": {
+				Type:        framework.TypeString,
+				Description: "How the client authenticates to the token endpoint: 'client_secret_basic', 'client_secret_post', 'private_key_jwt', or 'none' for public clients using PKCE. Defaults to 'client_secret_basic'.",
+			},
+			"oidc_client_signing_key": {
+				Type:             framework.TypeString,
+				Description:      "The PEM-encoded RSA or EC private key used to sign client assertions when 'oidc_client_auth_method' is 'private_key_jwt'. It is never returned when reading the config.",
+				DisplaySensitive: true,
+			},
+			"oidc_additional_audiences": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "A list of audiences, such as the client IDs of other applications, that are accepted in ID tokens in addition to 'oidc_client_id'.",
+			},
 			"default_role": {
 				Type:        framework.TypeString,
 				Description: "The default role to use if none is provided during login. If not set, a role is required during login.",
 			},
+			"default_roles": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `An ordered list of roles to try during OIDC logins that do not specify a role. The login completes with the first role whose constraints the token satisfies. Roles whose OIDC request settings (scopes, nonce, response mode, prompt, max age and ACR values) differ from those of the first role allowing the redirect URI are skipped. Cannot be used with "default_role".`,
+			},
+			"role_claim": {
+				Type:        framework.TypeString,
+				Description: `A claim, which may be a JSON pointer, naming the role to use for OIDC logins that specify no role when no default role is set. Only roles in "role_claim_allowed_roles" can be selected this way.`,
+			},
+			"role_claim_allowed_roles": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `The roles that may be selected through "role_claim". Required if "role_claim" is set.`,
+			},
+			"claim_type_hints": {
+				Type:        framework.TypeKVPairs,
+				Description: "Map of claims, which may be JSON pointers, to the type they are coerced to before they are checked or mapped: 'string', 'number', 'bool' or 'array'. A scalar claim hinted as 'array' becomes a list of one value. Claims that are not listed are used as received.",
+			},
 			"jwt_validation_pubkeys": {
 				Type:        framework.TypeCommaStringSlice,
-				Description: `A list of PEM-encoded public keys to use to authenticate signatures locally. Cannot be used with "oidc_discovery_url".`,
+				Description: `A list of PEM-encoded public keys to use to authenticate signatures locally. Cannot be used with "jwks_url" or "oidc_discovery_url".`,
 			},
 			"jwt_supported_algs": {
 				Type:        framework.TypeCommaStringSlice,
-				Description: `A list of supported signing algorithms. Defaults to RS256.`,
+				Description: `A list of supported signing algorithms. Defaults to RS256 when using OIDC discovery. If not set when using "jwt_validation_pubkeys" or "jwks_url", any algorithm supported by the keys is accepted.`,
 			},
 			"bound_issuer": {
 				Type:        framework.TypeString,
 				Description: "The value against which to match the 'iss' claim in a JWT. Optional.",
 			},
+			"oidc_http_proxy": {
+				Type:        framework.TypeString,
+				Description: "The URL of an HTTP or HTTPS proxy to use for all requests to the OIDC provider. If not set, the proxy environment variables are used.",
+			},
+			"oidc_request_headers": {
+				Type:             framework.TypeKVPairs,
+				Description:      "Map of HTTP headers and values to send with every request to the OIDC provider or JWKS URL, e.g. an API key required by a gateway. Header values are never returned when reading the config.",
+				DisplaySensitive: true,
+			},
+			"oidc_request_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Default:     int(defaultOIDCRequestTimeout.Seconds()),
+				Description: "Timeout for each attempt of an HTTP request to the OIDC provider, including discovery, JWKS, code exchange and userinfo requests. Retried requests get the full timeout for every attempt. Set to 0 to disable. Defaults to 30 seconds.",
+			},
+			"oidc_max_retries": {
+				Type:        framework.TypeInt,
+				Default:     defaultOIDCMaxRetries,
+				Description: "Maximum number of times a GET request to the OIDC provider, such as discovery, JWKS or userinfo, is retried with exponential backoff after a network error or a 5xx response. The token request is never retried. Set to 0 to disable. Defaults to 2.",
+			},
+			"jwks_cache_ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration for which signing keys fetched from the OIDC provider or JWKS URL are cached. Keys are also refreshed, at most every 10 seconds, when a token is signed by an unknown key ID. If not set, the provider's cache headers are used.",
+			},
+			"clock_skew_leeway": {
+				Type:        framework.TypeDurationSecond,
+				Default:     int(defaultClockSkewLeeway.Seconds()),
+				Description: "Leeway allowed for clock drift between Vault and the token issuer when checking the nbf, exp, iat and auth_time claims. Set to 0 to allow no leeway. Defaults to 60 seconds.",
+			},
+			"verbose_oidc_logging": {
+				Type:        framework.TypeBool,
+				Description: "If set, the claims received during a failed OIDC login are logged at debug level. The claims may contain sensitive data, so this should only be enabled while troubleshooting. Defaults to false.",
+			},
+			"oidc_disable_userinfo": {
+				Type:        framework.TypeBool,
+				Description: "If set, the provider's userinfo endpoint is never called during OIDC logins, for providers that do not implement it. Logins with roles that set 'oidc_fetch_userinfo' fail. Defaults to false.",
+			},
+			"oidc_enable_pkce": {
+				Type:        framework.TypeBool,
+				Description: "If set, OIDC logins will use PKCE (RFC 7636) with the S256 code challenge method. Defaults to false.",
+			},
+			"oidc_state_ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration an OIDC login may take between requesting an auth_url and completing the callback. Defaults to 10 minutes.",
+			},
+			"oidc_state_length": {
+				Type:        framework.TypeInt,
+				Description: "Number of random bytes used to generate the OAuth state. Defaults to 20, minimum 16.",
+			},
+			"oidc_nonce_length": {
+				Type:        framework.TypeInt,
+				Description: "Number of random bytes used to generate the OIDC nonce. Defaults to 20, minimum 16.",
+			},
 		},
 
 		Operations: map[logical.Operation]framework.OperationHandler{
@@ -75,9 +194,19 @@ func pathConfig(b *jwtAuthBackend) *framework.Path {
 	}
 }
 
+// config returns the backend's configuration, loading and caching it on first
+// use. The cached config is shared by concurrent requests and must not be
+// modified; it is dropped whenever the config is written or invalidated.
 func (b *jwtAuthBackend) config(ctx context.Context, s logical.Storage) (*jwtConfig, error) {
 	b.l.RLock()
-	defer b.l.RUnlock()
+	config := b.cachedConfig
+	b.l.RUnlock()
+	if config != nil {
+		return config, nil
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
 
 	if b.cachedConfig != nil {
 		return b.cachedConfig, nil
@@ -91,7 +220,13 @@ func (b *jwtAuthBackend) config(ctx context.Context, s logical.Storage) (*jwtCon
 		return nil, nil
 	}
 
-	result := &jwtConfig{}
+	// Fields added after the config was stored are absent from the entry and
+	// keep their defaults.
+	result := &jwtConfig{
+		OIDCRequestTimeout: defaultOIDCRequestTimeout,
+		OIDCMaxRetries:     defaultOIDCMaxRetries,
+		ClockSkewLeeway:    defaultClockSkewLeeway,
+	}
 	if entry != nil {
 		if err := entry.DecodeJSON(result); err != nil {
 			return nil, err
@@ -122,13 +257,35 @@ func (b *jwtAuthBackend) pathConfigRead(ctx context.Context, req *logical.Reques
 
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"oidc_discovery_url":     config.OIDCDiscoveryURL,
-			"oidc_discovery_ca_pem":  config.OIDCDiscoveryCAPEM,
-			"oidc_client_id":         config.OIDCClientID,
-			"default_role":           config.DefaultRole,
-			"jwt_validation_pubkeys": config.JWTValidationPubKeys,
-			"jwt_supported_algs":     config.JWTSupportedAlgs,
-			"bound_issuer":           config.BoundIssuer,
+			"oidc_discovery_url":          config.OIDCDiscoveryURL,
+			"oidc_discovery_ca_pem":       config.OIDCDiscoveryCAPEM,
+			"jwks_url":                    config.JWKSURL,
+			"jwks_ca_pem":                 config.JWKSCAPEM,
+			"oidc_http_proxy":             config.OIDCHTTPProxy,
+			"oidc_request_headers":        redactRequestHeaders(config.OIDCRequestHeaders),
+			"oidc_request_timeout":        int64(config.OIDCRequestTimeout.Seconds()),
+			"oidc_max_retries":            config.OIDCMaxRetries,
+			"oidc_client_id":              config.OIDCClientID,
+			"oidc_client_secret_set":      config.OIDCClientSecret != "",
+			"oidc_client_auth_method":     config.OIDCClientAuthMethod,
+			"oidc_client_signing_key_set": config.OIDCClientSigningKey != "",
+			"oidc_additional_audiences":   config.OIDCAdditionalAudiences,
+			"default_role":                config.DefaultRole,
+			"default_roles":               config.DefaultRoles,
+			"role_claim":                  config.RoleClaim,
+			"role_claim_allowed_roles":    config.RoleClaimAllowedRoles,
+			"claim_type_hints":            config.ClaimTypeHints,
+			"jwt_validation_pubkeys":      config.JWTValidationPubKeys,
+			"jwt_supported_algs":          config.JWTSupportedAlgs,
+			"bound_issuer":                config.BoundIssuer,
+			"oidc_disable_userinfo":       config.OIDCDisableUserInfo,
+			"oidc_enable_pkce":            config.OIDCEnablePKCE,
+			"oidc_state_ttl":              int64(config.OIDCStateTTL.Seconds()),
+			"jwks_cache_ttl":              int64(config.JWKSCacheTTL.Seconds()),
+			"clock_skew_leeway":           int64(config.ClockSkewLeeway.Seconds()),
+			"verbose_oidc_logging":        config.VerboseOIDCLogging,
+			"oidc_state_length":           config.OIDCStateLength,
+			"oidc_nonce_length":           config.OIDCNonceLength,
 		},
 	}
 
@@ -136,29 +293,173 @@ func (b *jwtAuthBackend) pathConfigRead(ctx context.Context, req *logical.Reques
 }
 
 func (b *jwtAuthBackend) pathConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	config := &jwtConfig{
-		OIDCDiscoveryURL:     d.Get("oidc_discovery_url").(string),
-		OIDCDiscoveryCAPEM:   d.Get("oidc_discovery_ca_pem").(string),
-		OIDCClientID:         d.Get("oidc_client_id").(string),
-		OIDCClientSecret:     d.Get("oidc_client_secret").(string),
-		DefaultRole:          d.Get("default_role").(string),
-		JWTValidationPubKeys: d.Get("jwt_validation_pubkeys").([]string),
-		JWTSupportedAlgs:     d.Get("jwt_supported_algs").([]string),
-		BoundIssuer:          d.Get("bound_issuer").(string),
+	existing, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Updates are merged into the existing config so that only the provided
+	// fields change. A field is cleared by explicitly setting it to an empty
+	// value. When the config is first written every field is taken from the
+	// request, picking up the defaults for those that were not provided.
+	config := &jwtConfig{}
+	if existing != nil {
+		*config = *existing
+		config.ParsedJWTPubKeys = nil
+	}
+	provided := func(name string) bool {
+		_, ok := d.GetOk(name)
+		return ok || existing == nil
+	}
+
+	if provided("oidc_discovery_url") {
+		config.OIDCDiscoveryURL = d.Get("oidc_discovery_url").(string)
+	}
+	if provided("oidc_discovery_ca_pem") {
+		config.OIDCDiscoveryCAPEM = d.Get("oidc_discovery_ca_pem").(string)
+	}
+	if provided("jwks_url") {
+		config.JWKSURL = d.Get("jwks_url").(string)
+	}
+	if provided("jwks_ca_pem") {
+		config.JWKSCAPEM = d.Get("jwks_ca_pem").(string)
+	}
+	if provided("oidc_http_proxy") {
+		config.OIDCHTTPProxy = d.Get("oidc_http_proxy").(string)
+	}
+	if provided("oidc_request_timeout") {
+		config.OIDCRequestTimeout = time.Duration(d.Get("oidc_request_timeout").(int)) * time.Second
+	}
+	if provided("oidc_max_retries") {
+		config.OIDCMaxRetries = d.Get("oidc_max_retries").(int)
+	}
+	if provided("oidc_client_id") {
+		config.OIDCClientID = d.Get("oidc_client_id").(string)
+	}
+	if provided("oidc_client_secret") {
+		config.OIDCClientSecret = d.Get("oidc_client_secret").(string)
+	}
+	if provided("oidc_request_headers") {
+		config.OIDCRequestHeaders = make(map[string]string)
+		for name, value := range d.Get("oidc_request_headers").(map[string]string) {
+			if !validHeaderName(name) || !validHeaderValue(value) {
+				return logical.ErrorResponse("invalid header in 'oidc_request_headers': %q", name), nil
+			}
+			config.OIDCRequestHeaders[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	if provided("oidc_client_auth_method") {
+		config.OIDCClientAuthMethod = d.Get("oidc_client_auth_method").(string)
+	}
+	if provided("oidc_client_signing_key") {
+		config.OIDCClientSigningKey = d.Get("oidc_client_signing_key").(string)
+	}
+	if provided("oidc_additional_audiences") {
+		config.OIDCAdditionalAudiences = d.Get("oidc_additional_audiences").([]string)
+	}
+	if provided("default_role") {
+		config.DefaultRole = d.Get("default_role").(string)
+	}
+	if provided("default_roles") {
+		config.DefaultRoles = d.Get("default_roles").([]string)
+	}
+	if provided("role_claim") {
+		config.RoleClaim = d.Get("role_claim").(string)
+	}
+	if provided("role_claim_allowed_roles") {
+		config.RoleClaimAllowedRoles = d.Get("role_claim_allowed_roles").([]string)
+		for i, roleName := range config.RoleClaimAllowedRoles {
+			config.RoleClaimAllowedRoles[i] = strings.ToLower(roleName)
+		}
+	}
+	if provided("claim_type_hints") {
+		config.ClaimTypeHints = make(map[string]string)
+		for claim, claimType := range d.Get("claim_type_hints").(map[string]string) {
+			switch claimType {
+			case claimTypeString, claimTypeNumber, claimTypeBool, claimTypeArray:
+			default:
+				return logical.ErrorResponse("invalid type %q for claim %q in 'claim_type_hints': must be 'string', 'number', 'bool' or 'array'", claimType, claim), nil
+			}
+			config.ClaimTypeHints[claim] = claimType
+		}
+	}
+	if provided("jwt_validation_pubkeys") {
+		config.JWTValidationPubKeys = d.Get("jwt_validation_pubkeys").([]string)
+	}
+	if provided("jwt_supported_algs") {
+		config.JWTSupportedAlgs = d.Get("jwt_supported_algs").([]string)
+	}
+	if provided("bound_issuer") {
+		config.BoundIssuer = d.Get("bound_issuer").(string)
+	}
+	if provided("oidc_disable_userinfo") {
+		config.OIDCDisableUserInfo = d.Get("oidc_disable_userinfo").(bool)
+	}
+	if provided("oidc_enable_pkce") {
+		config.OIDCEnablePKCE = d.Get("oidc_enable_pkce").(bool)
+	}
+	if provided("oidc_state_ttl") {
+		config.OIDCStateTTL = time.Duration(d.Get("oidc_state_ttl").(int)) * time.Second
+	}
+	if provided("jwks_cache_ttl") {
+		config.JWKSCacheTTL = time.Duration(d.Get("jwks_cache_ttl").(int)) * time.Second
+	}
+	if provided("clock_skew_leeway") {
+		config.ClockSkewLeeway = time.Duration(d.Get("clock_skew_leeway").(int)) * time.Second
+	}
+	if provided("verbose_oidc_logging") {
+		config.VerboseOIDCLogging = d.Get("verbose_oidc_logging").(bool)
+	}
+	if provided("oidc_state_length") {
+		config.OIDCStateLength = d.Get("oidc_state_length").(int)
+	}
+	if provided("oidc_nonce_length") {
+		config.OIDCNonceLength = d.Get("oidc_nonce_length").(int)
+	}
+
+	if config.OIDCHTTPProxy != "" {
+		if _, err := parseProxyURL(config.OIDCHTTPProxy); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	switch config.OIDCClientAuthMethod {
+	case "", clientAuthMethodBasic, clientAuthMethodPost, clientAuthMethodNone:
+	case clientAuthMethodPrivateKeyJWT:
+		if config.OIDCClientSigningKey == "" {
+			return logical.ErrorResponse("'oidc_client_signing_key' must be set when 'oidc_client_auth_method' is %q", clientAuthMethodPrivateKeyJWT), nil
+		}
+		if _, err := parseClientSigningKey(config.OIDCClientSigningKey); err != nil {
+			return logical.ErrorResponse(errwrap.Wrapf("error parsing 'oidc_client_signing_key': {{err}}", err).Error()), nil
+		}
+	default:
+		return logical.ErrorResponse("invalid 'oidc_client_auth_method': %s", config.OIDCClientAuthMethod), nil
 	}
 
 	// Run checks on values
+	methodCount := 0
+	if config.OIDCDiscoveryURL != "" {
+		methodCount++
+	}
+	if len(config.JWTValidationPubKeys) != 0 {
+		methodCount++
+	}
+	if config.JWKSURL != "" {
+		methodCount++
+	}
+
+	var provider *oidc.Provider
 	switch {
-	case config.OIDCDiscoveryURL == "" && len(config.JWTValidationPubKeys) == 0,
-		config.OIDCDiscoveryURL != "" && len(config.JWTValidationPubKeys) != 0:
-		return logical.ErrorResponse("exactly one of 'oidc_discovery_url' and 'jwt_validation_pubkeys' must be set"), nil
+	case methodCount != 1:
+		return logical.ErrorResponse("exactly one of 'oidc_discovery_url', 'jwks_url' and 'jwt_validation_pubkeys' must be set"), nil
 
-	case config.OIDCClientID != "" && config.OIDCClientSecret == "",
+	case config.OIDCClientID != "" && config.OIDCClientSecret == "" && config.clientAuthUsesSecret(),
 		config.OIDCClientID == "" && config.OIDCClientSecret != "":
 		return logical.ErrorResponse("both 'oidc_client_id' and 'oidc_client_secret' must be set for OIDC"), nil
 
 	case config.OIDCDiscoveryURL != "":
-		_, err := b.createProvider(config)
+		var err error
+		provider, err = b.createProvider(config)
 		if err != nil {
 			return logical.ErrorResponse(errwrap.Wrapf("error checking discovery URL: {{err}}", err).Error()), nil
 		}
@@ -166,6 +467,15 @@ func (b *jwtAuthBackend) pathConfigWrite(ctx context.Context, req *logical.Reque
 	case config.OIDCClientID != "" && config.OIDCDiscoveryURL == "":
 		return logical.ErrorResponse("'oidc_discovery_url' must be set for OIDC"), nil
 
+	case config.JWKSURL != "":
+		oidcCtx, err := b.createOIDCContext(b.providerCtx, config)
+		if err != nil {
+			return logical.ErrorResponse(errwrap.Wrapf("error checking JWKS URL: {{err}}", err).Error()), nil
+		}
+		if _, err := newJWKSKeySet(oidcCtx, config.JWKSURL, 0).fetch(); err != nil {
+			return logical.ErrorResponse(errwrap.Wrapf("error checking JWKS URL: {{err}}", err).Error()), nil
+		}
+
 	case len(config.JWTValidationPubKeys) != 0:
 		for _, v := range config.JWTValidationPubKeys {
 			if _, err := certutil.ParsePublicKeyPEM([]byte(v)); err != nil {
@@ -177,12 +487,35 @@ func (b *jwtAuthBackend) pathConfigWrite(ctx context.Context, req *logical.Reque
 		return nil, errors.New("unknown condition")
 	}
 
-	for _, a := range config.JWTSupportedAlgs {
-		switch a {
-		case oidc.RS256, oidc.RS384, oidc.RS512, oidc.ES256, oidc.ES384, oidc.ES512, oidc.PS256, oidc.PS384, oidc.PS512:
-		default:
-			return logical.ErrorResponse(fmt.Sprintf("Invalid supported algorithm: %s", a)), nil
-		}
+	if config.DefaultRole != "" && len(config.DefaultRoles) != 0 {
+		return logical.ErrorResponse("only one of 'default_role' and 'default_roles' may be set"), nil
+	}
+
+	if (config.RoleClaim == "") != (len(config.RoleClaimAllowedRoles) == 0) {
+		return logical.ErrorResponse("'role_claim' and 'role_claim_allowed_roles' must be set together"), nil
+	}
+
+	if config.JWKSCacheTTL < 0 {
+		return logical.ErrorResponse("'jwks_cache_ttl' must not be negative"), nil
+	}
+
+	if config.ClockSkewLeeway < 0 {
+		return logical.ErrorResponse("'clock_skew_leeway' must not be negative"), nil
+	}
+
+	if config.OIDCMaxRetries < 0 {
+		return logical.ErrorResponse("'oidc_max_retries' must not be negative"), nil
+	}
+
+	if config.OIDCStateLength != 0 && config.OIDCStateLength < minOIDCRandomLength {
+		return logical.ErrorResponse("'oidc_state_length' must be at least %d", minOIDCRandomLength), nil
+	}
+	if config.OIDCNonceLength != 0 && config.OIDCNonceLength < minOIDCRandomLength {
+		return logical.ErrorResponse("'oidc_nonce_length' must be at least %d", minOIDCRandomLength), nil
+	}
+
+	if err := validateSupportedAlgs(config.JWTSupportedAlgs); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
 	entry, err := logical.StorageEntryJSON(configPath, config)
@@ -193,18 +526,47 @@ func (b *jwtAuthBackend) pathConfigWrite(ctx context.Context, req *logical.Reque
 		return nil, err
 	}
 
+	// Install the provider that was just validated so that changes to the
+	// discovery URL or CA certificates take effect immediately.
 	b.reset()
+	b.l.Lock()
+	b.provider = provider
+	b.l.Unlock()
 
 	return nil, nil
 }
 
 func (b *jwtAuthBackend) createProvider(config *jwtConfig) (*oidc.Provider, error) {
+	oidcCtx, err := b.createOIDCContext(b.providerCtx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := oidc.NewProvider(oidcCtx, config.OIDCDiscoveryURL)
+	if err != nil {
+		return nil, errwrap.Wrapf("error creating provider with given values: {{err}}", err)
+	}
+
+	return provider, nil
+}
+
+// createOIDCContext returns a context with a custom HTTP client for requests
+// made to the OIDC provider or JWKS URL. The client trusts the configured CA
+// certificates, or the system roots if none are set, and uses the configured
+// proxy and request headers, if any.
+func (b *jwtAuthBackend) createOIDCContext(ctx context.Context, config *jwtConfig) (context.Context, error) {
 	var certPool *x509.CertPool
-	if config.OIDCDiscoveryCAPEM != "" {
+	switch {
+	case config.OIDCDiscoveryCAPEM != "":
 		certPool = x509.NewCertPool()
 		if ok := certPool.AppendCertsFromPEM([]byte(config.OIDCDiscoveryCAPEM)); !ok {
 			return nil, errors.New("could not parse 'oidc_discovery_ca_pem' value successfully")
 		}
+	case config.JWKSCAPEM != "":
+		certPool = x509.NewCertPool()
+		if ok := certPool.AppendCertsFromPEM([]byte(config.JWKSCAPEM)); !ok {
+			return nil, errors.New("could not parse 'jwks_ca_pem' value successfully")
+		}
 	}
 
 	tr := cleanhttp.DefaultPooledTransport()
@@ -213,28 +575,308 @@ func (b *jwtAuthBackend) createProvider(config *jwtConfig) (*oidc.Provider, erro
 			RootCAs: certPool,
 		}
 	}
+	if config.OIDCHTTPProxy != "" {
+		proxyURL, err := parseProxyURL(config.OIDCHTTPProxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	var base http.RoundTripper = tr
+	if len(config.OIDCRequestHeaders) > 0 {
+		base = &headerTransport{
+			base:    tr,
+			headers: config.OIDCRequestHeaders,
+		}
+	}
 	tc := &http.Client{
-		Transport: tr,
+		Transport: &retryTransport{
+			base:       base,
+			timeout:    config.OIDCRequestTimeout,
+			maxRetries: config.OIDCMaxRetries,
+			minWait:    oidcRetryMinWait,
+			maxWait:    oidcRetryMaxWait,
+		},
 	}
-	oidcCtx := context.WithValue(b.providerCtx, oauth2.HTTPClient, tc)
 
-	provider, err := oidc.NewProvider(oidcCtx, config.OIDCDiscoveryURL)
+	return context.WithValue(ctx, oauth2.HTTPClient, tc), nil
+}
+
+// Bounds for the exponential backoff between retried requests to the OIDC
+// provider.
+const (
+	oidcRetryMinWait = 100 * time.Millisecond
+	oidcRetryMaxWait = 2 * time.Second
+)
+
+// retryTransport limits each attempt of a request to the OIDC provider to the
+// configured timeout, and retries GET and HEAD requests that failed with a
+// network error, including a timeout, or a 5xx response, with exponential
+// backoff. Other requests, notably the token request, are sent only once: the
+// provider may have acted on a request whose response was lost, and an
+// authorization code can only be redeemed once.
+type retryTransport struct {
+	base       http.RoundTripper
+	timeout    time.Duration
+	maxRetries int
+	minWait    time.Duration
+	maxWait    time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.roundTripOnce(req)
+	}
+
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.roundTripOnce(req)
+
+		retry, _ := retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+		if !retry || attempt >= t.maxRetries {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryablehttp.DefaultBackoff(t.minWait, t.maxWait, attempt, resp)):
+		}
+	}
+}
+
+// roundTripOnce sends a single attempt of req. The timeout covers reading the
+// response body too, so it is only released once the body is closed.
+func (t *retryTransport) roundTripOnce(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
 	if err != nil {
-		return nil, errwrap.Wrapf("error creating provider with given values: {{err}}", err)
+		cancel()
+		return nil, err
 	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
 
-	return provider, nil
+// cancelOnClose releases the context of a request once its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// validateSupportedAlgs checks that each of the algorithms in a
+// jwt_supported_algs list is a known signing algorithm.
+func validateSupportedAlgs(algs []string) error {
+	for _, a := range algs {
+		if strings.EqualFold(a, algNone) {
+			return errors.New("the 'none' algorithm cannot be used in 'jwt_supported_algs'")
+		}
+		switch a {
+		case oidc.RS256, oidc.RS384, oidc.RS512, oidc.ES256, oidc.ES384, oidc.ES512, oidc.PS256, oidc.PS384, oidc.PS512:
+		default:
+			return fmt.Errorf("Invalid supported algorithm: %s", a)
+		}
+	}
+	return nil
+}
+
+// headerTransport sets the configured headers on each request before sending
+// it.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it is given, so the headers
+	// are set on a copy with its own header map.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+len(t.headers))
+	for name, values := range req.Header {
+		r.Header[name] = append([]string(nil), values...)
+	}
+	for name, value := range t.headers {
+		r.Header.Set(name, value)
+	}
+	return t.base.RoundTrip(r)
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name, which
+// must be a non-empty token as defined by RFC 7230, section 3.2.6.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue reports whether value is a valid HTTP header field value,
+// which must not contain control characters other than horizontal tab.
+func validHeaderValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// redactRequestHeaders returns the names of the configured request headers
+// with their values redacted, as the values often contain credentials.
+func redactRequestHeaders(headers map[string]string) map[string]string {
+	redacted := make(map[string]string, len(headers))
+	for name := range headers {
+		redacted[name] = "redacted"
+	}
+	return redacted
+}
+
+// parseProxyURL parses and validates an HTTP or HTTPS proxy URL.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errwrap.Wrapf("could not parse 'oidc_http_proxy': {{err}}", err)
+	}
+	if (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+		return nil, fmt.Errorf("'oidc_http_proxy' must be an http or https URL, got %q", proxy)
+	}
+	return proxyURL, nil
+}
+
+// parseClientSigningKey parses a PEM-encoded RSA or EC private key used to
+// sign client assertions, choosing the signing algorithm from the key type.
+func parseClientSigningKey(pemKey string) (jose.SigningKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return jose.SigningKey{}, errors.New("no PEM block found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return jose.SigningKey{}, errors.New("unsupported private key, expected an RSA or EC key")
+			}
+		}
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.SigningKey{Algorithm: jose.RS256, Key: k}, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return jose.SigningKey{Algorithm: jose.ES256, Key: k}, nil
+		case 384:
+			return jose.SigningKey{Algorithm: jose.ES384, Key: k}, nil
+		case 521:
+			return jose.SigningKey{Algorithm: jose.ES512, Key: k}, nil
+		}
+	}
+
+	return jose.SigningKey{}, errors.New("unsupported private key, expected an RSA or EC key")
+}
+
+// defaultRoles returns the roles to try, in order, for OIDC logins that do not
+// specify a role.
+func (c *jwtConfig) defaultRoles() []string {
+	if c.DefaultRole != "" {
+		return []string{c.DefaultRole}
+	}
+	return c.DefaultRoles
+}
+
+// stateTTL returns the lifetime of OIDC login states.
+func (c *jwtConfig) stateTTL() time.Duration {
+	if c.OIDCStateTTL > 0 {
+		return c.OIDCStateTTL
+	}
+	return oidcStateTimeout
+}
+
+// clientAuthUsesSecret reports whether the client authenticates to the token
+// endpoint with its client secret.
+func (c *jwtConfig) clientAuthUsesSecret() bool {
+	switch c.OIDCClientAuthMethod {
+	case clientAuthMethodPrivateKeyJWT, clientAuthMethodNone:
+		return false
+	}
+	return true
+}
+
+// stateLength returns the number of random bytes in an OAuth state.
+func (c *jwtConfig) stateLength() int {
+	if c.OIDCStateLength > 0 {
+		return c.OIDCStateLength
+	}
+	return defaultOIDCRandomLength
+}
+
+// nonceLength returns the number of random bytes in an OIDC nonce.
+func (c *jwtConfig) nonceLength() int {
+	if c.OIDCNonceLength > 0 {
+		return c.OIDCNonceLength
+	}
+	return defaultOIDCRandomLength
 }
 
 type jwtConfig struct {
-	OIDCDiscoveryURL     string   `json:"oidc_discovery_url"`
-	OIDCDiscoveryCAPEM   string   `json:"oidc_discovery_ca_pem"`
-	OIDCClientID         string   `json:"oidc_client_id"`
-	OIDCClientSecret     string   `json:"oidc_client_secret"`
-	JWTValidationPubKeys []string `json:"jwt_validation_pubkeys"`
-	JWTSupportedAlgs     []string `json:"jwt_supported_algs"`
-	BoundIssuer          string   `json:"bound_issuer"`
-	DefaultRole          string   `json:"default_role"`
+	OIDCDiscoveryURL        string            `json:"oidc_discovery_url"`
+	OIDCDiscoveryCAPEM      string            `json:"oidc_discovery_ca_pem"`
+	JWKSURL                 string            `json:"jwks_url"`
+	JWKSCAPEM               string            `json:"jwks_ca_pem"`
+	OIDCHTTPProxy           string            `json:"oidc_http_proxy"`
+	OIDCRequestHeaders      map[string]string `json:"oidc_request_headers"`
+	OIDCRequestTimeout      time.Duration     `json:"oidc_request_timeout"`
+	OIDCMaxRetries          int               `json:"oidc_max_retries"`
+	OIDCClientID            string            `json:"oidc_client_id"`
+	OIDCClientSecret        string            `json:"oidc_client_secret"`
+	OIDCClientAuthMethod    string            `json:"oidc_client_auth_method"`
+	OIDCClientSigningKey    string            `json:"oidc_client_signing_key"`
+	OIDCAdditionalAudiences []string          `json:"oidc_additional_audiences"`
+	ClaimTypeHints          map[string]string `json:"claim_type_hints"`
+	JWTValidationPubKeys    []string          `json:"jwt_validation_pubkeys"`
+	JWTSupportedAlgs        []string          `json:"jwt_supported_algs"`
+	BoundIssuer             string            `json:"bound_issuer"`
+	DefaultRole             string            `json:"default_role"`
+	DefaultRoles            []string          `json:"default_roles"`
+	RoleClaim               string            `json:"role_claim"`
+	RoleClaimAllowedRoles   []string          `json:"role_claim_allowed_roles"`
+	OIDCDisableUserInfo     bool              `json:"oidc_disable_userinfo"`
+	OIDCEnablePKCE          bool              `json:"oidc_enable_pkce"`
+	OIDCStateTTL            time.Duration     `json:"oidc_state_ttl"`
+	OIDCStateLength         int               `json:"oidc_state_length"`
+	OIDCNonceLength         int               `json:"oidc_nonce_length"`
+	JWKSCacheTTL            time.Duration     `json:"jwks_cache_ttl"`
+	ClockSkewLeeway         time.Duration     `json:"clock_skew_leeway"`
+	VerboseOIDCLogging      bool              `json:"verbose_oidc_logging"`
 
 	ParsedJWTPubKeys []interface{} `json:"-"`
 }
@@ -246,7 +888,12 @@ Configures the JWT authentication backend.
 	confHelpDesc = `
 The JWT authentication backend validates JWTs (or OIDC) using the configured
 credentials. If using OIDC Discovery, the URL must be provided, along
-with (optionally) the CA cert to use for the connection. If performing JWT
-validation locally, a set of public keys must be provided.
+with (optionally) the CA cert to use for the connection. If using a JWKS URL,
+the URL must be provided, along with (optionally) the CA cert to use for the
+connection. If performing JWT validation locally, a set of public keys must
+be provided.
+
+Updates only change the fields that are provided; a field is cleared by
+setting it to an empty value.
 `
 )
@@ -2,9 +2,15 @@ package jwtauth
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/hashicorp/vault/helper/certutil"
@@ -15,13 +21,33 @@ func TestConfig_JWT_Read(t *testing.T) {
 	b, storage := getBackend(t)
 
 	data := map[string]interface{}{
-		"oidc_discovery_url":     "",
-		"oidc_discovery_ca_pem":  "",
-		"oidc_client_id":         "",
-		"default_role":           "",
-		"jwt_validation_pubkeys": []string{testJWTPubKey},
-		"jwt_supported_algs":     []string{},
-		"bound_issuer":           "http://vault.example.com/",
+		"oidc_discovery_url":        "",
+		"oidc_discovery_ca_pem":     "",
+		"jwks_url":                  "",
+		"jwks_ca_pem":               "",
+		"oidc_http_proxy":           "",
+		"oidc_request_headers":      map[string]string{},
+		"oidc_request_timeout":      int64(30),
+		"oidc_max_retries":          2,
+		"oidc_client_id":            "",
+		"oidc_client_auth_method":   "",
+		"oidc_additional_audiences": []string{},
+		"default_role":              "",
+		"default_roles":             []string{},
+		"role_claim":                "",
+		"role_claim_allowed_roles":  []string{},
+		"claim_type_hints":          map[string]string{},
+		"jwt_validation_pubkeys":    []string{testJWTPubKey},
+		"jwt_supported_algs":        []string{},
+		"bound_issuer":              "http://vault.example.com/",
+		"oidc_disable_userinfo":     false,
+		"oidc_enable_pkce":          false,
+		"oidc_state_ttl":            int64(0),
+		"jwks_cache_ttl":            int64(0),
+		"clock_skew_leeway":         int64(0),
+		"verbose_oidc_logging":      false,
+		"oidc_state_length":         0,
+		"oidc_nonce_length":         0,
 	}
 
 	req := &logical.Request{
@@ -48,11 +74,147 @@ func TestConfig_JWT_Read(t *testing.T) {
 		t.Fatalf("err:%s resp:%#v\n", err, resp)
 	}
 
+	data["oidc_client_secret_set"] = false
+	data["oidc_client_signing_key_set"] = false
 	if diff := deep.Equal(resp.Data, data); diff != nil {
 		t.Fatalf("Expected did not equal actual: %v", diff)
 	}
 }
 
+func TestConfig_ClientSecretRedacted(t *testing.T) {
+	b, storage := getBackend(t)
+
+	// The config is stored directly since writing OIDC settings through the
+	// API requires a reachable discovery URL.
+	entry, err := logical.StorageEntryJSON(configPath, &jwtConfig{
+		OIDCDiscoveryURL: "https://team-vault.auth0.com/",
+		OIDCClientID:     "abc",
+		OIDCClientSecret: "very-secret-value",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      configPath,
+		Storage:   storage,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	if _, ok := resp.Data["oidc_client_secret"]; ok {
+		t.Fatal("oidc_client_secret should not be returned")
+	}
+	if strings.Contains(fmt.Sprintf("%#v", resp.Data), "very-secret-value") {
+		t.Fatal("client secret found in read response")
+	}
+	if resp.Data["oidc_client_secret_set"] != true {
+		t.Fatalf("expected oidc_client_secret_set to be true, got %v", resp.Data["oidc_client_secret_set"])
+	}
+}
+
+func TestConfig_OIDCClientAuthMethod(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+
+	tests := []struct {
+		data   map[string]interface{}
+		errMsg string
+	}{
+		{
+			map[string]interface{}{"oidc_client_auth_method": "client_secret_basic", "oidc_client_secret": "def"},
+			"",
+		},
+		{
+			map[string]interface{}{"oidc_client_auth_method": "client_secret_post"},
+			"both 'oidc_client_id' and 'oidc_client_secret' must be set for OIDC",
+		},
+		{
+			map[string]interface{}{"oidc_client_auth_method": "none"},
+			"",
+		},
+		{
+			map[string]interface{}{"oidc_client_auth_method": "tls_client_auth"},
+			"invalid 'oidc_client_auth_method': tls_client_auth",
+		},
+		{
+			map[string]interface{}{"oidc_client_auth_method": "private_key_jwt"},
+			"'oidc_client_signing_key' must be set when 'oidc_client_auth_method' is \"private_key_jwt\"",
+		},
+		{
+			map[string]interface{}{"oidc_client_auth_method": "private_key_jwt", "oidc_client_signing_key": "not a key"},
+			"error parsing 'oidc_client_signing_key': no PEM block found",
+		},
+		{
+			map[string]interface{}{"oidc_client_auth_method": "private_key_jwt", "oidc_client_signing_key": ecdsaPrivKey},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		data := map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_client_id":     "abc",
+		}
+		for k, v := range test.data {
+			data[k] = v
+		}
+
+		// Start from an empty config so that earlier cases don't leak in
+		if err := storage.Delete(context.Background(), configPath); err != nil {
+			t.Fatal(err)
+		}
+		b.(*jwtAuthBackend).reset()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data:      data,
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.errMsg == "" {
+			if resp != nil && resp.IsError() {
+				t.Fatalf("%v: unexpected error: %v", test.data, resp.Error())
+			}
+			continue
+		}
+		if resp == nil || !resp.IsError() || resp.Error().Error() != test.errMsg {
+			t.Fatalf("%v: expected error %q, got: %#v", test.data, test.errMsg, resp)
+		}
+	}
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      configPath,
+		Storage:   storage,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+	if _, ok := resp.Data["oidc_client_signing_key"]; ok {
+		t.Fatal("the client signing key must not be returned")
+	}
+	if resp.Data["oidc_client_signing_key_set"] != true {
+		t.Fatalf("expected oidc_client_signing_key_set to be true, got %v", resp.Data["oidc_client_signing_key_set"])
+	}
+}
+
 func TestConfig_JWT_Write(t *testing.T) {
 	b, storage := getBackend(t)
 
@@ -100,10 +262,18 @@ func TestConfig_JWT_Write(t *testing.T) {
 	}
 
 	expected := &jwtConfig{
-		ParsedJWTPubKeys:     []interface{}{pubkey},
-		JWTValidationPubKeys: []string{testJWTPubKey},
-		JWTSupportedAlgs:     []string{},
-		BoundIssuer:          "http://vault.example.com/",
+		ParsedJWTPubKeys:        []interface{}{pubkey},
+		JWTValidationPubKeys:    []string{testJWTPubKey},
+		JWTSupportedAlgs:        []string{},
+		OIDCAdditionalAudiences: []string{},
+		DefaultRoles:            []string{},
+		RoleClaimAllowedRoles:   []string{},
+		OIDCRequestHeaders:      map[string]string{},
+		ClaimTypeHints:          map[string]string{},
+		OIDCRequestTimeout:      30 * time.Second,
+		OIDCMaxRetries:          2,
+		ClockSkewLeeway:         60 * time.Second,
+		BoundIssuer:             "http://vault.example.com/",
 	}
 
 	conf, err := b.(*jwtAuthBackend).config(context.Background(), storage)
@@ -116,6 +286,199 @@ func TestConfig_JWT_Write(t *testing.T) {
 	}
 }
 
+func TestConfig_PartialUpdate(t *testing.T) {
+	b, storage := getBackend(t)
+
+	write := func(data map[string]interface{}, expectErr bool) {
+		t.Helper()
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data:      data,
+		}
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (resp != nil && resp.IsError()) != expectErr {
+			t.Fatalf("unexpected response: %#v", resp)
+		}
+	}
+
+	write(map[string]interface{}{
+		"jwt_validation_pubkeys": testJWTPubKey,
+		"bound_issuer":           "http://vault.example.com/",
+		"default_role":           "dev",
+		"oidc_request_timeout":   "10",
+	}, false)
+
+	pubkey, err := certutil.ParsePublicKeyPEM([]byte(testJWTPubKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &jwtConfig{
+		ParsedJWTPubKeys:        []interface{}{pubkey},
+		JWTValidationPubKeys:    []string{testJWTPubKey},
+		JWTSupportedAlgs:        []string{},
+		OIDCAdditionalAudiences: []string{},
+		DefaultRoles:            []string{},
+		RoleClaimAllowedRoles:   []string{},
+		OIDCRequestHeaders:      map[string]string{},
+		ClaimTypeHints:          map[string]string{},
+		OIDCRequestTimeout:      10 * time.Second,
+		OIDCMaxRetries:          2,
+		ClockSkewLeeway:         60 * time.Second,
+		BoundIssuer:             "http://vault.example.com/",
+		DefaultRole:             "dev",
+	}
+
+	check := func() {
+		t.Helper()
+		conf, err := b.(*jwtAuthBackend).config(context.Background(), storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(expected, conf); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+
+	// Only the provided field is changed.
+	write(map[string]interface{}{
+		"bound_issuer": "http://vault2.example.com/",
+	}, false)
+	expected.BoundIssuer = "http://vault2.example.com/"
+	check()
+
+	// Fields are cleared by setting them to an empty value.
+	write(map[string]interface{}{
+		"default_role": "",
+	}, false)
+	expected.DefaultRole = ""
+	check()
+
+	// A rejected update leaves the stored config unchanged.
+	write(map[string]interface{}{
+		"jwks_url": "https://example.com/certs",
+	}, true)
+	check()
+}
+
+func TestConfig_JWT_SupportedAlgs(t *testing.T) {
+	b, storage := getBackend(t)
+
+	tests := []struct {
+		algs      []string
+		errPrefix string
+	}{
+		{[]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "PS384", "PS512"}, ""},
+		{[]string{"ES256", "HS256"}, "Invalid supported algorithm"},
+		{[]string{"rs256"}, "Invalid supported algorithm"},
+		{[]string{"RS256", "none"}, "the 'none' algorithm cannot be used"},
+		{[]string{"None"}, "the 'none' algorithm cannot be used"},
+	}
+
+	for _, test := range tests {
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"jwt_validation_pubkeys": []string{testJWTPubKey},
+				"jwt_supported_algs":     test.algs,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.errPrefix == "" {
+			if resp != nil && resp.IsError() {
+				t.Fatalf("algs %v: unexpected error: %v", test.algs, resp.Error())
+			}
+			continue
+		}
+		if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), test.errPrefix) {
+			t.Fatalf("algs %v: expected error %q, got: %#v", test.algs, test.errPrefix, resp)
+		}
+	}
+}
+
+func TestConfig_JWKS_Write(t *testing.T) {
+	b, storage := getBackend(t)
+
+	s := newJWKSServer(t, "key-1")
+	defer s.server.Close()
+
+	data := map[string]interface{}{
+		"jwks_url":               s.server.URL + "/certs",
+		"jwt_validation_pubkeys": []string{testJWTPubKey},
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected error")
+	}
+	if !strings.HasPrefix(resp.Error().Error(), "exactly one of") {
+		t.Fatalf("got unexpected error: %v", resp.Error())
+	}
+
+	delete(data, "jwt_validation_pubkeys")
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	expected := &jwtConfig{
+		JWKSURL:                 s.server.URL + "/certs",
+		JWTValidationPubKeys:    []string{},
+		JWTSupportedAlgs:        []string{},
+		OIDCAdditionalAudiences: []string{},
+		DefaultRoles:            []string{},
+		RoleClaimAllowedRoles:   []string{},
+		OIDCRequestHeaders:      map[string]string{},
+		ClaimTypeHints:          map[string]string{},
+		OIDCRequestTimeout:      30 * time.Second,
+		OIDCMaxRetries:          2,
+		ClockSkewLeeway:         60 * time.Second,
+	}
+
+	conf, err := b.(*jwtAuthBackend).config(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expected, conf) {
+		t.Fatalf("expected did not match actual: expected %#v\n got %#v\n", expected, conf)
+	}
+
+	// The JWKS URL must be reachable.
+	data["jwks_url"] = "http://127.0.0.1:1/certs"
+	data["oidc_max_retries"] = 0
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "error checking JWKS URL") {
+		t.Fatalf("expected JWKS URL error, got: %#v", resp)
+	}
+}
+
 func TestConfig_OIDC_Write(t *testing.T) {
 	b, storage := getBackend(t)
 
@@ -148,9 +511,17 @@ func TestConfig_OIDC_Write(t *testing.T) {
 	}
 
 	expected := &jwtConfig{
-		JWTValidationPubKeys: []string{},
-		JWTSupportedAlgs:     []string{},
-		OIDCDiscoveryURL:     "https://team-vault.auth0.com/",
+		JWTValidationPubKeys:    []string{},
+		JWTSupportedAlgs:        []string{},
+		OIDCAdditionalAudiences: []string{},
+		DefaultRoles:            []string{},
+		RoleClaimAllowedRoles:   []string{},
+		OIDCRequestHeaders:      map[string]string{},
+		ClaimTypeHints:          map[string]string{},
+		OIDCRequestTimeout:      30 * time.Second,
+		OIDCMaxRetries:          2,
+		ClockSkewLeeway:         60 * time.Second,
+		OIDCDiscoveryURL:        "https://team-vault.auth0.com/",
 	}
 
 	conf, err := b.(*jwtAuthBackend).config(context.Background(), storage)
@@ -238,3 +609,118 @@ ff4hAtoAmN0/x6yFclFFWX8s7bRGqmnoj39/r98kzeGFb/lPKgQjSVcBJuE7UO4k
 sj9DpQ==
 -----END CERTIFICATE-----`
 )
+
+func TestConfig_StoredBeforeRequestSettings(t *testing.T) {
+	b, storage := getBackend(t)
+
+	// A config stored before the request settings were added has no value for
+	// them and picks up the defaults.
+	entry := &logical.StorageEntry{
+		Key:   configPath,
+		Value: []byte(`{"jwks_url": "https://example.com/certs", "bound_issuer": "https://example.com"}`),
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      configPath,
+		Storage:   storage,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	if resp.Data["oidc_request_timeout"] != int64(30) || resp.Data["oidc_max_retries"] != 2 {
+		t.Fatalf("expected default request settings, got timeout %v and retries %v", resp.Data["oidc_request_timeout"], resp.Data["oidc_max_retries"])
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	var requests, failures, slow int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if slow > 0 {
+			slow--
+			time.Sleep(200 * time.Millisecond)
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(503)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &retryTransport{
+			base:       http.DefaultTransport,
+			timeout:    100 * time.Millisecond,
+			maxRetries: 2,
+			minWait:    time.Millisecond,
+			maxWait:    time.Millisecond,
+		},
+	}
+
+	for _, test := range []struct {
+		name             string
+		method           string
+		failures         int
+		slow             int
+		expectedStatus   int
+		expectedRequests int
+	}{
+		{"GET retry then succeed", "GET", 2, 0, 200, 3},
+		{"GET retries exhausted", "GET", 3, 0, 503, 3},
+		{"GET timeout is per attempt", "GET", 0, 2, 200, 3},
+		{"POST not retried", "POST", 1, 0, 503, 1},
+	} {
+		requests, failures, slow = 0, test.failures, test.slow
+
+		var body io.Reader
+		if test.method == "POST" {
+			body = strings.NewReader("code=abc")
+		}
+		req, err := http.NewRequest(test.method, server.URL, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("case %q: %v", test.name, err)
+		}
+		// the body can still be read after the transport returned
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("case %q: %v", test.name, err)
+		}
+
+		if resp.StatusCode != test.expectedStatus {
+			t.Fatalf("case %q: expected status %d, got %d", test.name, test.expectedStatus, resp.StatusCode)
+		}
+		if resp.StatusCode == 200 && string(respBody) != "ok" {
+			t.Fatalf("case %q: unexpected body %q", test.name, respBody)
+		}
+		if requests != test.expectedRequests {
+			t.Fatalf("case %q: expected %d requests, got %d", test.name, test.expectedRequests, requests)
+		}
+	}
+
+	// a POST that times out is not retried
+	requests, slow = 0, 1
+	req, err := http.NewRequest("POST", server.URL, strings.NewReader("code=abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); err == nil || !strings.Contains(err.Error(), "context deadline exceeded") {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("expected 1 request, got %d", requests)
+	}
+}
@@ -4,16 +4,25 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/helper/cidrutil"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
+// algNone is the JWS algorithm for unsigned tokens, which is never accepted.
+const algNone = "none"
+
+// tokenExpiryKey is the auth internal data key holding the login token's
+// expiry for roles with bound_token_ttl.
+const tokenExpiryKey = "token_expiry"
+
 func pathLogin(b *jwtAuthBackend) *framework.Path {
 	return &framework.Path{
 		Pattern: `login$`,
@@ -78,28 +87,50 @@ func (b *jwtAuthBackend) pathLogin(ctx context.Context, req *logical.Request, d
 	}
 
 	// Here is where things diverge. If it is using OIDC Discovery, validate
-	// that way; otherwise validate against the locally configured keys. Once
-	// things are validated, we re-unify the request path when evaluating the
-	// claims.
+	// that way; otherwise validate against the locally configured keys or the
+	// keys fetched from the JWKS URL. Once things are validated, we re-unify
+	// the request path when evaluating the claims.
 	allClaims := map[string]interface{}{}
 	switch {
-	case len(config.ParsedJWTPubKeys) != 0:
+	case len(config.ParsedJWTPubKeys) != 0, config.JWKSURL != "":
 		parsedJWT, err := jwt.ParseSigned(token)
 		if err != nil {
 			return logical.ErrorResponse(errwrap.Wrapf("error parsing token: {{err}}", err).Error()), nil
 		}
 
+		supportedAlgs, err := role.supportedAlgs(config)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		if err := validateSigningAlg(parsedJWT, supportedAlgs); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
 		claims := jwt.Claims{}
 
-		var valid bool
-		for _, key := range config.ParsedJWTPubKeys {
-			if err := parsedJWT.Claims(key, &claims, &allClaims); err == nil {
-				valid = true
-				break
+		if config.JWKSURL != "" {
+			keySet, err := b.getKeySet(config, config.JWKSURL)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := keySet.VerifySignature(ctx, token); err != nil {
+				return logical.ErrorResponse(errwrap.Wrapf("error verifying token signature: {{err}}", err).Error()), nil
+			}
+			// The signature was verified by the key set above.
+			if err := parsedJWT.UnsafeClaimsWithoutVerification(&claims, &allClaims); err != nil {
+				return logical.ErrorResponse(errwrap.Wrapf("error parsing claims: {{err}}", err).Error()), nil
+			}
+		} else {
+			var valid bool
+			for _, key := range config.ParsedJWTPubKeys {
+				if err := parsedJWT.Claims(key, &claims, &allClaims); err == nil {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				return logical.ErrorResponse("no known key successfully validated the token signature"), nil
 			}
-		}
-		if !valid {
-			return logical.ErrorResponse("no known key successfully validated the token signature"), nil
 		}
 
 		// We require notbefore or expiry; if only one is provided, we allow 5 minutes of leeway.
@@ -134,13 +165,19 @@ func (b *jwtAuthBackend) pathLogin(ctx context.Context, req *logical.Request, d
 			return logical.ErrorResponse("audience claim found in JWT but no audiences bound to the role"), nil
 		}
 
+		if role.BoundSubject != "" && role.BoundSubject != claims.Subject {
+			return logical.ErrorResponse("error validating claims: sub claim does not match bound subject"), nil
+		}
+
+		if err := validateIssuer(role.boundIssuer(config), claims.Issuer); err != nil {
+			return logical.ErrorResponse("error validating claims: %s", err.Error()), nil
+		}
+
 		expected := jwt.Expected{
-			Issuer:  config.BoundIssuer,
-			Subject: role.BoundSubject,
-			Time:    time.Now(),
+			Time: time.Now(),
 		}
 
-		if err := claims.Validate(expected); err != nil {
+		if err := claims.ValidateWithLeeway(expected, config.ClockSkewLeeway); err != nil {
 			return logical.ErrorResponse(errwrap.Wrapf("error validating claims: {{err}}", err).Error()), nil
 		}
 
@@ -158,7 +195,19 @@ func (b *jwtAuthBackend) pathLogin(ctx context.Context, req *logical.Request, d
 		return nil, errors.New("unhandled case during login")
 	}
 
-	if err := validateBoundClaims(b.Logger(), role.BoundClaims, allClaims); err != nil {
+	if err := applyClaimTypeHints(allClaims, config.ClaimTypeHints); err != nil {
+		return logical.ErrorResponse("error validating claims: %s", err.Error()), nil
+	}
+
+	if err := validateBoundClaims(b.Logger(), role.BoundClaimsType, role.BoundClaims, allClaims); err != nil {
+		return logical.ErrorResponse("error validating claims: %s", err.Error()), nil
+	}
+
+	if err := validateForbiddenClaims(b.Logger(), role.ForbiddenClaims, allClaims); err != nil {
+		return logical.ErrorResponse("error validating claims: %s", err.Error()), nil
+	}
+
+	if err := validateRequiredClaims(b.Logger(), role.RequiredClaims, allClaims); err != nil {
 		return logical.ErrorResponse("error validating claims: %s", err.Error()), nil
 	}
 
@@ -172,6 +221,9 @@ func (b *jwtAuthBackend) pathLogin(ctx context.Context, req *logical.Request, d
 		tokenMetadata[k] = v
 	}
 
+	internalData := authInternalData(roleName, role, allClaims)
+	ttl, maxTTL := role.leaseTTLs(internalData)
+
 	resp := &logical.Response{
 		Auth: &logical.Auth{
 			Policies:     role.Policies,
@@ -180,14 +232,12 @@ func (b *jwtAuthBackend) pathLogin(ctx context.Context, req *logical.Request, d
 			NumUses:      role.NumUses,
 			Alias:        alias,
 			GroupAliases: groupAliases,
-			InternalData: map[string]interface{}{
-				"role": roleName,
-			},
-			Metadata: tokenMetadata,
+			InternalData: internalData,
+			Metadata:     tokenMetadata,
 			LeaseOptions: logical.LeaseOptions{
 				Renewable: true,
-				TTL:       role.TTL,
-				MaxTTL:    role.MaxTTL,
+				TTL:       ttl,
+				MaxTTL:    maxTTL,
 			},
 			BoundCIDRs: role.BoundCIDRs,
 		},
@@ -212,8 +262,7 @@ func (b *jwtAuthBackend) pathLoginRenew(ctx context.Context, req *logical.Reques
 	}
 
 	resp := &logical.Response{Auth: req.Auth}
-	resp.Auth.TTL = role.TTL
-	resp.Auth.MaxTTL = role.MaxTTL
+	resp.Auth.TTL, resp.Auth.MaxTTL = role.leaseTTLs(req.Auth.InternalData)
 	resp.Auth.Period = role.Period
 	return resp, nil
 }
@@ -221,36 +270,94 @@ func (b *jwtAuthBackend) pathLoginRenew(ctx context.Context, req *logical.Reques
 func (b *jwtAuthBackend) verifyOIDCToken(ctx context.Context, config *jwtConfig, role *jwtRole, rawToken string) (map[string]interface{}, error) {
 	allClaims := make(map[string]interface{})
 
+	// The verifier restricts the algorithm as well, but unsigned tokens are
+	// rejected before any keys are fetched.
+	parsedJWT, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return nil, errwrap.Wrapf("error parsing token: {{err}}", err)
+	}
+	if err := validateSigningAlg(parsedJWT, nil); err != nil {
+		return nil, err
+	}
+
+	var unverifiedClaims jwt.Claims
+	if err := parsedJWT.UnsafeClaimsWithoutVerification(&unverifiedClaims); err != nil {
+		return nil, errwrap.Wrapf("error parsing claims: {{err}}", err)
+	}
+
+	supportedAlgs, err := role.supportedAlgs(config)
+	if err != nil {
+		return nil, err
+	}
+
 	provider, err := b.getProvider(ctx, config)
 	if err != nil {
 		return nil, errwrap.Wrapf("error getting provider for login operation: {{err}}", err)
 	}
 
+	// The time claims are checked below, allowing for clock skew.
 	oidcConfig := &oidc.Config{
-		SupportedSigningAlgs: config.JWTSupportedAlgs,
+		SupportedSigningAlgs: supportedAlgs,
+		SkipExpiryCheck:      true,
 	}
 
-	if role.RoleType == "oidc" {
+	// The verifier can only check for a single client ID, so the audience is
+	// checked below if additional audiences are accepted.
+	if role.RoleType == "oidc" && len(config.OIDCAdditionalAudiences) == 0 {
 		oidcConfig.ClientID = config.OIDCClientID
 	} else {
 		oidcConfig.SkipClientIDCheck = true
 	}
-	verifier := provider.Verifier(oidcConfig)
+	verifier, err := b.getVerifier(config, provider, oidcConfig, unverifiedClaims.Issuer)
+	if err != nil {
+		return nil, errwrap.Wrapf("error getting verifier for login operation: {{err}}", err)
+	}
 
 	idToken, err := verifier.Verify(ctx, rawToken)
+	if err != nil && keyFetchFailed(err) {
+		// The provider may have moved its JWKS since discovery was performed,
+		// so retry once against freshly discovered metadata.
+		if refreshed, ok := b.rediscoverProvider(config, provider); ok {
+			b.Logger().Warn("retrying token verification with re-discovered provider metadata", "error", err)
+			verifier, err = b.getVerifier(config, refreshed, oidcConfig, unverifiedClaims.Issuer)
+			if err != nil {
+				return nil, errwrap.Wrapf("error getting verifier for login operation: {{err}}", err)
+			}
+			idToken, err = verifier.Verify(ctx, rawToken)
+		}
+	}
 	if err != nil {
 		return nil, errwrap.Wrapf("error validating signature: {{err}}", err)
 	}
 
+	// The claims parsed above belong to the token whose signature was just
+	// verified, so their times can now be checked.
+	if err := validateTokenTimes(unverifiedClaims, config.ClockSkewLeeway); err != nil {
+		return nil, errwrap.Wrapf("error validating claims: {{err}}", err)
+	}
+
+	if role.RoleType == "oidc" && len(config.OIDCAdditionalAudiences) > 0 {
+		clientIDs := append([]string{config.OIDCClientID}, config.OIDCAdditionalAudiences...)
+		if err := validateAudience(clientIDs, idToken.Audience, false); err != nil {
+			return nil, errwrap.Wrapf("error validating client ID: {{err}}", err)
+		}
+	}
+
 	if err := idToken.Claims(&allClaims); err != nil {
 		return nil, errwrap.Wrapf("unable to successfully parse all claims from token: {{err}}", err)
 	}
 
+	// The provider's issuer is verified above, but a role may further restrict
+	// the accepted issuer.
+	if err := validateIssuer(role.BoundIssuer, idToken.Issuer); err != nil {
+		return nil, err
+	}
+
 	if role.BoundSubject != "" && role.BoundSubject != idToken.Subject {
 		return nil, errors.New("sub claim does not match bound subject")
 	}
 
-	if err := validateAudience(role.BoundAudiences, idToken.Audience, false); err != nil {
+	if err := validateAudience(role.BoundAudiences, idToken.Audience, role.BoundAudiencesStrict); err != nil {
 		return nil, errwrap.Wrapf("error validating claims: {{err}}", err)
 	}
 
@@ -260,16 +367,12 @@ func (b *jwtAuthBackend) verifyOIDCToken(ctx context.Context, config *jwtConfig,
 // createIdentity creates an alias and set of groups aliases based on the role
 // definition and received claims.
 func (b *jwtAuthBackend) createIdentity(allClaims map[string]interface{}, role *jwtRole) (*logical.Alias, []*logical.Alias, error) {
-	userClaimRaw, ok := allClaims[role.UserClaim]
-	if !ok {
-		return nil, nil, fmt.Errorf("claim %q not found in token", role.UserClaim)
-	}
-	userName, ok := userClaimRaw.(string)
-	if !ok {
-		return nil, nil, fmt.Errorf("claim %q could not be converted to string", role.UserClaim)
+	userName, err := b.aliasName(allClaims, role)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	metadata, err := extractMetadata(b.Logger(), allClaims, role.ClaimMappings)
+	metadata, err := extractMetadata(b.Logger(), allClaims, role.ClaimMappings, role.ClaimMappingsDelim)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -281,34 +384,204 @@ func (b *jwtAuthBackend) createIdentity(allClaims map[string]interface{}, role *
 
 	var groupAliases []*logical.Alias
 
-	if role.GroupsClaim == "" {
+	if len(role.GroupsClaims) == 0 {
 		return alias, groupAliases, nil
 	}
 
-	groupsClaimRaw := getClaim(b.Logger(), allClaims, role.GroupsClaim)
+	// The values of all groups claims are merged, dropping duplicates. Claims
+	// missing from the token are skipped, as long as at least one is present.
+	found := false
+	seen := make(map[string]bool)
+	for _, groupsClaim := range role.GroupsClaims {
+		groupsClaimRaw := getClaim(b.Logger(), allClaims, groupsClaim)
+		if groupsClaimRaw == nil {
+			continue
+		}
+		found = true
+
+		groups, ok := normalizeGroupsClaim(groupsClaimRaw, role.GroupsClaimDelim)
+		if !ok {
+			return nil, nil, fmt.Errorf("%q claim could not be converted to string list", groupsClaim)
+		}
+		for _, groupRaw := range groups {
+			group, ok := groupRaw.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("value %v in groups claim could not be parsed as string", groupRaw)
+			}
+			if group == "" || seen[group] {
+				continue
+			}
+			seen[group] = true
+			groupAliases = append(groupAliases, &logical.Alias{
+				Name: group,
+			})
+		}
+	}
+
+	if !found {
+		return nil, nil, fmt.Errorf("%q claim not found in token", strings.Join(role.GroupsClaims, ","))
+	}
+
+	return alias, groupAliases, nil
+}
+
+// verifyAccessToken verifies the signature and time claims of an access token
+// issued as a JWT by the provider, and returns its claims. Unlike ID tokens,
+// access tokens are intended for resource servers, so their audience is not
+// checked.
+func (b *jwtAuthBackend) verifyAccessToken(ctx context.Context, config *jwtConfig, role *jwtRole, provider *oidc.Provider, rawToken string) (map[string]interface{}, error) {
+	parsedJWT, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return nil, errwrap.Wrapf("the access token is not a JWT: {{err}}", err)
+	}
 
-	if groupsClaimRaw == nil {
-		return nil, nil, fmt.Errorf("%q claim not found in token", role.GroupsClaim)
+	supportedAlgs, err := role.supportedAlgs(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSigningAlg(parsedJWT, supportedAlgs); err != nil {
+		return nil, err
 	}
-	groups, ok := groupsClaimRaw.([]interface{})
 
-	if !ok {
-		return nil, nil, fmt.Errorf("%q claim could not be converted to string list", role.GroupsClaim)
+	var unverifiedClaims jwt.Claims
+	if err := parsedJWT.UnsafeClaimsWithoutVerification(&unverifiedClaims); err != nil {
+		return nil, errwrap.Wrapf("error parsing access token claims: {{err}}", err)
 	}
-	for _, groupRaw := range groups {
-		group, ok := groupRaw.(string)
-		if !ok {
-			return nil, nil, fmt.Errorf("value %v in groups claim could not be parsed as string", groupRaw)
+
+	// The time claims are checked below, allowing for clock skew.
+	oidcConfig := &oidc.Config{
+		SupportedSigningAlgs: supportedAlgs,
+		SkipClientIDCheck:    true,
+		SkipExpiryCheck:      true,
+	}
+	verifier, err := b.getVerifier(config, provider, oidcConfig, unverifiedClaims.Issuer)
+	if err != nil {
+		return nil, errwrap.Wrapf("error getting verifier for access token: {{err}}", err)
+	}
+
+	token, err := verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, errwrap.Wrapf("error validating access token signature: {{err}}", err)
+	}
+
+	if err := validateTokenTimes(unverifiedClaims, config.ClockSkewLeeway); err != nil {
+		return nil, errwrap.Wrapf("error validating access token claims: {{err}}", err)
+	}
+
+	allClaims := make(map[string]interface{})
+	if err := token.Claims(&allClaims); err != nil {
+		return nil, errwrap.Wrapf("error parsing access token claims: {{err}}", err)
+	}
+
+	return allClaims, nil
+}
+
+// validateTokenTimes checks the nbf, exp and iat claims of a token against the
+// current time, allowing for leeway. go-jose skips the expiry check if the exp
+// claim is missing, so it is required here, as go-oidc's verifier would.
+func validateTokenTimes(claims jwt.Claims, leeway time.Duration) error {
+	if claims.Expiry == nil {
+		return errors.New("token is missing the exp claim")
+	}
+	return claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, leeway)
+}
+
+// validateSigningAlg checks that every signature on the token uses one of the
+// supported algorithms. Unsigned tokens are always rejected. If no algorithms
+// are configured, any algorithm that the configured keys can verify is
+// accepted.
+func validateSigningAlg(parsedJWT *jwt.JSONWebToken, supportedAlgs []string) error {
+	for _, header := range parsedJWT.Headers {
+		if strings.EqualFold(header.Algorithm, algNone) {
+			return errors.New("unsigned tokens using the 'none' algorithm are not allowed")
+		}
+		if len(supportedAlgs) != 0 && !strutil.StrListContains(supportedAlgs, header.Algorithm) {
+			return fmt.Errorf("unsupported signing algorithm: %s", header.Algorithm)
+		}
+	}
+
+	return nil
+}
+
+// aliasName returns the Identity entity alias name, taken either from the
+// role's user_claim, or the first of its user_claim_fallbacks present in the
+// token, or by rendering its user_claim_template.
+func (b *jwtAuthBackend) aliasName(allClaims map[string]interface{}, role *jwtRole) (string, error) {
+	if role.UserClaimTemplate != "" {
+		userName, err := renderClaimTemplate(b.Logger(), allClaims, role.UserClaimTemplate)
+		if err != nil {
+			return "", errwrap.Wrapf("error rendering user_claim_template: {{err}}", err)
 		}
-		if group == "" {
+		if userName == "" {
+			return "", errors.New("user_claim_template rendered an empty alias name")
+		}
+		return userName, nil
+	}
+
+	// The fallbacks are only consulted if the user_claim is missing or empty,
+	// so that a token never produces an alias with an empty name.
+	empty := false
+	for _, userClaim := range append([]string{role.UserClaim}, role.UserClaimFallbacks...) {
+		userClaimRaw := getClaim(b.Logger(), allClaims, userClaim)
+		if userClaimRaw == nil {
 			continue
 		}
-		groupAliases = append(groupAliases, &logical.Alias{
-			Name: group,
-		})
+		userName, ok := userClaimRaw.(string)
+		if !ok {
+			return "", fmt.Errorf("claim %q could not be converted to string", userClaim)
+		}
+		if userName != "" {
+			return userName, nil
+		}
+		empty = true
 	}
 
-	return alias, groupAliases, nil
+	switch {
+	case len(role.UserClaimFallbacks) > 0:
+		return "", fmt.Errorf("claim %q and its fallbacks %q not found in token or empty", role.UserClaim, role.UserClaimFallbacks)
+	case empty:
+		return "", fmt.Errorf("claim %q is empty", role.UserClaim)
+	}
+	return "", fmt.Errorf("claim %q not found in token", role.UserClaim)
+}
+
+// normalizeGroupsClaim returns the groups claim as a list. Providers that emit
+// groups as a single string have it split on delim, or on whitespace if delim
+// is empty. Lists are returned unchanged.
+func normalizeGroupsClaim(raw interface{}, delim string) ([]interface{}, bool) {
+	switch v := raw.(type) {
+	case []interface{}:
+		return v, true
+	case string:
+		var parts []string
+		if delim == "" {
+			parts = strings.Fields(v)
+		} else {
+			parts = strings.Split(v, delim)
+		}
+
+		groups := make([]interface{}, 0, len(parts))
+		for _, part := range parts {
+			groups = append(groups, strings.TrimSpace(part))
+		}
+		return groups, true
+	}
+
+	return nil, false
+}
+
+// authInternalData returns the internal data stored with tokens issued for the
+// role. The login token's expiry is recorded for roles with bound_token_ttl.
+func authInternalData(roleName string, role *jwtRole, allClaims map[string]interface{}) map[string]interface{} {
+	internalData := map[string]interface{}{
+		"role": roleName,
+	}
+	if role.BoundTokenTTL {
+		if expiry, ok := claimTime(allClaims["exp"]); ok {
+			internalData[tokenExpiryKey] = expiry.Unix()
+		}
+	}
+	return internalData
 }
 
 const (
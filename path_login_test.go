@@ -3,9 +3,13 @@ package jwtauth
 import (
 	"context"
 	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -497,6 +501,9 @@ func TestLogin_JWT(t *testing.T) {
 		if !resp.IsError() {
 			t.Fatalf("expected error: %v", *resp)
 		}
+		if !strings.Contains(resp.Error().Error(), "sub claim does not match bound subject") {
+			t.Fatalf("unexpected error: %v", resp.Error())
+		}
 	}
 
 	// test bad expiry (using auto expiry)
@@ -694,64 +701,162 @@ func TestLogin_JWT(t *testing.T) {
 	}
 }
 
-func TestLogin_OIDC(t *testing.T) {
-	b, storage := setupBackend(t, true, true, false)
+func TestLogin_JWT_ClockSkewLeeway(t *testing.T) {
+	b, storage := setupBackend(t, false, true, false)
 
-	jwtData := getTestOIDC(t)
+	tests := []struct {
+		leeway      string
+		expiredFor  time.Duration
+		errExpected bool
+	}{
+		// the default leeway is 60 seconds
+		{"", 30 * time.Second, false},
+		{"", 90 * time.Second, true},
+		{"120", 90 * time.Second, false},
+		{"120", 150 * time.Second, true},
+		{"0", 30 * time.Second, true},
+	}
 
-	data := map[string]interface{}{
-		"role": "plugin-test",
-		"jwt":  jwtData,
+	for _, test := range tests {
+		if test.leeway != "" {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      configPath,
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"clock_skew_leeway": test.leeway,
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%s resp:%#v\n", err, resp)
+			}
+		}
+
+		cl := jwt.Claims{
+			Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+			Issuer:    "https://team-vault.auth0.com/",
+			Audience:  jwt.Audience{"https://vault.plugin.auth.jwt.test"},
+			NotBefore: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+			Expiry:    jwt.NewNumericDate(time.Now().Add(-test.expiredFor)),
+		}
+
+		privateCl := struct {
+			User   string   `json:"https://vault/user"`
+			Groups []string `json:"https://vault/groups"`
+		}{
+			"jeff",
+			[]string{"foo", "bar"},
+		}
+
+		jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  jwtData,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsError() != test.errExpected {
+			t.Fatalf("leeway %q, expired for %v: expected error: %t, got: %#v", test.leeway, test.expiredFor, test.errExpected, resp)
+		}
+		if test.errExpected && !strings.Contains(resp.Error().Error(), "token is expired") {
+			t.Fatalf("unexpected error: %v", resp.Error())
+		}
 	}
+}
+
+func TestLogin_ForbiddenClaims(t *testing.T) {
+	b, storage := setupBackend(t, false, true, true)
 
 	req := &logical.Request{
 		Operation: logical.UpdateOperation,
-		Path:      "login",
+		Path:      "role/plugin-test",
 		Storage:   storage,
-		Data:      data,
+		Data: map[string]interface{}{
+			"role_type": "jwt",
+			"forbidden_claims": map[string]interface{}{
+				"account_status": []string{"suspended", "disabled"},
+			},
+		},
 	}
 
 	resp, err := b.HandleRequest(context.Background(), req)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if resp == nil {
-		t.Fatal("got nil response")
-	}
-	if resp.IsError() {
-		t.Fatalf("got error: %v", resp.Error())
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
 	}
 
-	auth := resp.Auth
-	switch {
-	case len(auth.Policies) != 1 || auth.Policies[0] != "test":
-		t.Fatal(auth.Policies)
-	case auth.Alias.Name != "jeff":
-		t.Fatal(auth.Alias.Name)
-	case len(auth.GroupAliases) != 2 || auth.GroupAliases[0].Name != "foo" || auth.GroupAliases[1].Name != "bar":
-		t.Fatal(auth.GroupAliases)
-	case auth.Period != 3*time.Second:
-		t.Fatal(auth.Period)
-	case auth.TTL != time.Second:
-		t.Fatal(auth.TTL)
-	case auth.MaxTTL != 5*time.Second:
-		t.Fatal(auth.MaxTTL)
-	}
-}
+	for _, test := range []struct {
+		status      string
+		errExpected bool
+	}{
+		{"active", false},
+		{"suspended", true},
+	} {
+		cl := jwt.Claims{
+			Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+			Issuer:    "https://team-vault.auth0.com/",
+			Audience:  jwt.Audience{"https://vault.plugin.auth.jwt.test"},
+			NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+		}
 
-func TestLogin_NestedGroups(t *testing.T) {
-	b, storage := getBackend(t)
+		privateCl := struct {
+			User          string   `json:"https://vault/user"`
+			Groups        []string `json:"https://vault/groups"`
+			Color         string   `json:"color"`
+			AccountStatus string   `json:"account_status"`
+		}{
+			"jeff",
+			[]string{"foo", "bar"},
+			"green",
+			test.status,
+		}
 
-	data := map[string]interface{}{
-		"bound_issuer":           "https://team-vault.auth0.com/",
-		"jwt_validation_pubkeys": ecdsaPubKey,
+		jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  jwtData,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsError() != test.errExpected {
+			t.Fatalf("status %q: expected error: %t, got: %#v", test.status, test.errExpected, resp)
+		}
+		if test.errExpected && resp.Error().Error() != `error validating claims: claim "account_status" matches a forbidden value` {
+			t.Fatalf("unexpected error: %v", resp.Error())
+		}
 	}
+}
+
+func TestLogin_GroupsClaimsMerged(t *testing.T) {
+	b, storage := setupBackend(t, false, true, true)
 
 	req := &logical.Request{
 		Operation: logical.UpdateOperation,
-		Path:      configPath,
+		Path:      "role/plugin-test",
 		Storage:   storage,
-		Data:      data,
+		Data: map[string]interface{}{
+			"role_type":    "jwt",
+			"groups_claim": "https://vault/groups,roles",
+		},
 	}
 
 	resp, err := b.HandleRequest(context.Background(), req)
@@ -759,95 +864,1032 @@ func TestLogin_NestedGroups(t *testing.T) {
 		t.Fatalf("err:%s resp:%#v\n", err, resp)
 	}
 
-	data = map[string]interface{}{
-		"role_type":       "jwt",
-		"bound_audiences": "https://vault.plugin.auth.jwt.test",
-		"bound_subject":   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
-		"user_claim":      "https://vault/user",
-		"groups_claim":    "/https/~1~1vault~1groups/testing",
-		"policies":        "test",
-		"period":          "3s",
-		"ttl":             "1s",
-		"num_uses":        12,
-		"max_ttl":         "5s",
+	cl := jwt.Claims{
+		Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+		Issuer:    "https://team-vault.auth0.com/",
+		Audience:  jwt.Audience{"https://vault.plugin.auth.jwt.test"},
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+	}
+
+	privateCl := struct {
+		User   string   `json:"https://vault/user"`
+		Groups []string `json:"https://vault/groups"`
+		Roles  []string `json:"roles"`
+		Color  string   `json:"color"`
+	}{
+		"jeff",
+		[]string{"foo", "bar"},
+		[]string{"bar", "baz"},
+		"green",
 	}
 
+	jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+
 	req = &logical.Request{
-		Operation: logical.CreateOperation,
-		Path:      "role/plugin-test",
+		Operation: logical.UpdateOperation,
+		Path:      "login",
 		Storage:   storage,
-		Data:      data,
+		Data: map[string]interface{}{
+			"role": "plugin-test",
+			"jwt":  jwtData,
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	var groups []string
+	for _, alias := range resp.Auth.GroupAliases {
+		groups = append(groups, alias.Name)
 	}
+	if diff := deep.Equal(groups, []string{"foo", "bar", "baz"}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// A token carrying only one of the claims still logs in
+	jwtData, _ = getTestJWT(t, ecdsaPrivKey, cl, struct {
+		User   string   `json:"https://vault/user"`
+		Groups []string `json:"https://vault/groups"`
+		Color  string   `json:"color"`
+	}{
+		"jeff",
+		[]string{"foo", "bar"},
+		"green",
+	})
+	req.Data["jwt"] = jwtData
 
 	resp, err = b.HandleRequest(context.Background(), req)
 	if err != nil || (resp != nil && resp.IsError()) {
 		t.Fatalf("err:%s resp:%#v\n", err, resp)
 	}
+	if len(resp.Auth.GroupAliases) != 2 {
+		t.Fatalf("unexpected group aliases: %#v", resp.Auth.GroupAliases)
+	}
+}
+
+func TestLogin_UserClaimFallbacks(t *testing.T) {
+	b, storage := setupBackend(t, false, true, false)
 
 	cl := jwt.Claims{
 		Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
 		Issuer:    "https://team-vault.auth0.com/",
-		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
 		Audience:  jwt.Audience{"https://vault.plugin.auth.jwt.test"},
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
 	}
 
-	type GroupsLevel2 struct {
-		Groups []string `json:"testing"`
+	login := func(privateCl interface{}) *logical.Response {
+		t.Helper()
+
+		jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  jwtData,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
 	}
-	type GroupsLevel1 struct {
-		Level2 GroupsLevel2 `json:"//vault/groups"`
+
+	missingUser := map[string]interface{}{
+		"email":                "jeff@example.com",
+		"color":                "green",
+		"https://vault/groups": []string{"foo"},
 	}
-	privateCl := struct {
-		User   string       `json:"https://vault/user"`
-		Level1 GroupsLevel1 `json:"https"`
-	}{
-		"jeff",
-		GroupsLevel1{
-			GroupsLevel2{
-				[]string{"foo", "bar"},
-			},
+	emptyUser := map[string]interface{}{
+		"https://vault/user":   "",
+		"email":                "jeff@example.com",
+		"color":                "green",
+		"https://vault/groups": []string{"foo"},
+	}
+
+	// Without fallbacks, a missing or empty user claim fails the login
+	resp := login(missingUser)
+	if resp == nil || !resp.IsError() || resp.Error().Error() != `claim "https://vault/user" not found in token` {
+		t.Fatalf("expected user claim error, got: %#v", resp)
+	}
+	resp = login(emptyUser)
+	if resp == nil || !resp.IsError() || resp.Error().Error() != `claim "https://vault/user" is empty` {
+		t.Fatalf("expected user claim error, got: %#v", resp)
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "role/plugin-test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_type":            "jwt",
+			"user_claim_fallbacks": "preferred_username,email",
 		},
 	}
 
-	jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
 
-	data = map[string]interface{}{
-		"role": "plugin-test",
-		"jwt":  jwtData,
+	// The first fallback present in the token is used
+	for _, privateCl := range []interface{}{missingUser, emptyUser} {
+		resp = login(privateCl)
+		if resp == nil || resp.IsError() {
+			t.Fatalf("unexpected error response: %#v", resp)
+		}
+		if resp.Auth.Alias.Name != "jeff@example.com" {
+			t.Fatalf("unexpected alias name: %q", resp.Auth.Alias.Name)
+		}
 	}
 
-	req = &logical.Request{
+	// The user claim takes precedence over the fallbacks
+	resp = login(map[string]interface{}{
+		"https://vault/user":   "jeff",
+		"email":                "jeff@example.com",
+		"color":                "green",
+		"https://vault/groups": []string{"foo"},
+	})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("unexpected error response: %#v", resp)
+	}
+	if resp.Auth.Alias.Name != "jeff" {
+		t.Fatalf("unexpected alias name: %q", resp.Auth.Alias.Name)
+	}
+
+	// The login still fails if no fallback is present either
+	resp = login(map[string]interface{}{
+		"color":                "green",
+		"https://vault/groups": []string{"foo"},
+	})
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "not found in token or empty") {
+		t.Fatalf("expected user claim error, got: %#v", resp)
+	}
+}
+
+func TestLogin_ClaimTypeHints(t *testing.T) {
+	b, storage := setupBackend(t, false, true, false)
+
+	req := &logical.Request{
 		Operation: logical.UpdateOperation,
-		Path:      "login",
+		Path:      configPath,
 		Storage:   storage,
-		Data:      data,
+		Data: map[string]interface{}{
+			"claim_type_hints": map[string]interface{}{"/org/primary": "uuid"},
+		},
 	}
 
-	resp, err = b.HandleRequest(context.Background(), req)
+	resp, err := b.HandleRequest(context.Background(), req)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp == nil {
-		t.Fatal("got nil response")
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "invalid type") {
+		t.Fatalf("expected error response, got: %#v", resp)
 	}
-	if resp.IsError() {
-		t.Fatalf("got error: %v", resp.Error())
+
+	req.Data["claim_type_hints"] = map[string]interface{}{
+		"https://vault/user": "string",
+		"/org/primary":       "string",
+		"admin":              "bool",
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
 	}
 
-	auth := resp.Auth
-	switch {
-	case len(auth.Policies) != 1 || auth.Policies[0] != "test":
-		t.Fatal(auth.Policies)
-	case auth.Alias.Name != "jeff":
-		t.Fatal(auth.Alias.Name)
-	case len(auth.GroupAliases) != 2 || auth.GroupAliases[0].Name != "foo" || auth.GroupAliases[1].Name != "bar":
-		t.Fatal(auth.GroupAliases)
-	case auth.Period != 3*time.Second:
-		t.Fatal(auth.Period)
-	case auth.TTL != time.Second:
-		t.Fatal(auth.TTL)
-	case auth.MaxTTL != 5*time.Second:
-		t.Fatal(auth.MaxTTL)
+	// The provider sends "admin" as a string, which the hint turns into the
+	// boolean the role's bound claim expects
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "role/plugin-test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_type": "jwt",
+			"bound_claims": map[string]interface{}{
+				"admin": true,
+			},
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	cl := jwt.Claims{
+		Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+		Issuer:    "https://team-vault.auth0.com/",
+		Audience:  jwt.Audience{"https://vault.plugin.auth.jwt.test"},
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+	}
+
+	login := func(admin interface{}) *logical.Response {
+		t.Helper()
+
+		jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, map[string]interface{}{
+			"https://vault/user":   1001,
+			"https://vault/groups": []string{"foo"},
+			"admin":                admin,
+			"org": map[string]interface{}{
+				"primary": 12345678901,
+			},
+		})
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  jwtData,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The numeric user claim can only be used as the alias name as a string
+	resp = login("true")
+	if resp == nil || resp.IsError() {
+		t.Fatalf("unexpected response: %#v", resp)
+	}
+	if resp.Auth.Alias.Name != "1001" {
+		t.Fatalf("unexpected alias name: %q", resp.Auth.Alias.Name)
+	}
+	if resp.Auth.Alias.Metadata["primary_org"] != "12345678901" {
+		t.Fatalf("unexpected metadata: %#v", resp.Auth.Alias.Metadata)
+	}
+
+	resp = login("maybe")
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), `claim "admin" could not be coerced to bool`) {
+		t.Fatalf("expected error response, got: %#v", resp)
+	}
+}
+
+func TestLogin_NumericBoundClaims(t *testing.T) {
+	b, storage := setupBackend(t, false, true, false)
+
+	cl := jwt.Claims{
+		Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+		Issuer:    "https://team-vault.auth0.com/",
+		Audience:  jwt.Audience{"https://vault.plugin.auth.jwt.test"},
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+	}
+
+	privateCl := struct {
+		User   string   `json:"https://vault/user"`
+		Groups []string `json:"https://vault/groups"`
+		SK     int      `json:"sk"`
+	}{
+		"jeff",
+		[]string{"foo", "bar"},
+		42,
+	}
+
+	jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+
+	for _, test := range []struct {
+		bound       interface{}
+		errExpected bool
+	}{
+		{"42", false},
+		{json.Number("42"), false},
+		{"43", true},
+		{json.Number("43"), true},
+	} {
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/plugin-test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role_type": "jwt",
+				"bound_claims": map[string]interface{}{
+					"sk": test.bound,
+				},
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  jwtData,
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsError() != test.errExpected {
+			t.Fatalf("bound value %#v: expected error: %t, got: %#v", test.bound, test.errExpected, resp)
+		}
+	}
+}
+
+func TestLogin_OIDC(t *testing.T) {
+	b, storage := setupBackend(t, true, true, false)
+
+	jwtData := getTestOIDC(t)
+
+	data := map[string]interface{}{
+		"role": "plugin-test",
+		"jwt":  jwtData,
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil {
+		t.Fatal("got nil response")
+	}
+	if resp.IsError() {
+		t.Fatalf("got error: %v", resp.Error())
+	}
+
+	auth := resp.Auth
+	switch {
+	case len(auth.Policies) != 1 || auth.Policies[0] != "test":
+		t.Fatal(auth.Policies)
+	case auth.Alias.Name != "jeff":
+		t.Fatal(auth.Alias.Name)
+	case len(auth.GroupAliases) != 2 || auth.GroupAliases[0].Name != "foo" || auth.GroupAliases[1].Name != "bar":
+		t.Fatal(auth.GroupAliases)
+	case auth.Period != 3*time.Second:
+		t.Fatal(auth.Period)
+	case auth.TTL != time.Second:
+		t.Fatal(auth.TTL)
+	case auth.MaxTTL != 5*time.Second:
+		t.Fatal(auth.MaxTTL)
+	}
+}
+
+func TestLogin_JWT_RoleBoundIssuer(t *testing.T) {
+	b, storage := setupBackend(t, false, true, false)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "role/plugin-test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_type":    "jwt",
+			"bound_issuer": "https://other-idp.example.com/",
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	privateCl := struct {
+		User   string   `json:"https://vault/user"`
+		Groups []string `json:"https://vault/groups"`
+	}{
+		"jeff",
+		[]string{"foo", "bar"},
+	}
+
+	tests := []struct {
+		issuer      string
+		errExpected bool
+	}{
+		{"https://other-idp.example.com/", false},
+		// trailing slashes are ignored when comparing issuers
+		{"https://other-idp.example.com", false},
+		// the config's bound_issuer no longer applies to the role
+		{"https://team-vault.auth0.com/", true},
+		{"https://team-vault.auth0.com", true},
+	}
+
+	for _, test := range tests {
+		cl := jwt.Claims{
+			Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+			Issuer:    test.issuer,
+			NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+			Audience:  jwt.Audience{"https://vault.plugin.auth.jwt.test"},
+		}
+
+		jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  jwtData,
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil {
+			t.Fatal("got nil response")
+		}
+		if resp.IsError() != test.errExpected {
+			t.Fatalf("issuer %q: expected error: %t, got: %v", test.issuer, test.errExpected, resp.Error())
+		}
+		if test.errExpected && !strings.Contains(resp.Error().Error(), "issuer") {
+			t.Fatalf("issuer %q: unexpected error: %v", test.issuer, resp.Error())
+		}
+	}
+}
+
+func TestLogin_NestedGroups(t *testing.T) {
+	b, storage := getBackend(t)
+
+	data := map[string]interface{}{
+		"bound_issuer":           "https://team-vault.auth0.com/",
+		"jwt_validation_pubkeys": ecdsaPubKey,
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	data = map[string]interface{}{
+		"role_type":       "jwt",
+		"bound_audiences": "https://vault.plugin.auth.jwt.test",
+		"bound_subject":   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+		"user_claim":      "https://vault/user",
+		"groups_claim":    "/https/~1~1vault~1groups/testing",
+		"policies":        "test",
+		"period":          "3s",
+		"ttl":             "1s",
+		"num_uses":        12,
+		"max_ttl":         "5s",
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/plugin-test",
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	cl := jwt.Claims{
+		Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+		Issuer:    "https://team-vault.auth0.com/",
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+		Audience:  jwt.Audience{"https://vault.plugin.auth.jwt.test"},
+	}
+
+	type GroupsLevel2 struct {
+		Groups []string `json:"testing"`
+	}
+	type GroupsLevel1 struct {
+		Level2 GroupsLevel2 `json:"//vault/groups"`
+	}
+	privateCl := struct {
+		User   string       `json:"https://vault/user"`
+		Level1 GroupsLevel1 `json:"https"`
+	}{
+		"jeff",
+		GroupsLevel1{
+			GroupsLevel2{
+				[]string{"foo", "bar"},
+			},
+		},
+	}
+
+	jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+
+	data = map[string]interface{}{
+		"role": "plugin-test",
+		"jwt":  jwtData,
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil {
+		t.Fatal("got nil response")
+	}
+	if resp.IsError() {
+		t.Fatalf("got error: %v", resp.Error())
+	}
+
+	auth := resp.Auth
+	switch {
+	case len(auth.Policies) != 1 || auth.Policies[0] != "test":
+		t.Fatal(auth.Policies)
+	case auth.Alias.Name != "jeff":
+		t.Fatal(auth.Alias.Name)
+	case len(auth.GroupAliases) != 2 || auth.GroupAliases[0].Name != "foo" || auth.GroupAliases[1].Name != "bar":
+		t.Fatal(auth.GroupAliases)
+	case auth.Period != 3*time.Second:
+		t.Fatal(auth.Period)
+	case auth.TTL != time.Second:
+		t.Fatal(auth.TTL)
+	case auth.MaxTTL != 5*time.Second:
+		t.Fatal(auth.MaxTTL)
+	}
+}
+
+func TestLogin_GroupsClaimString(t *testing.T) {
+	b, _ := getBackend(t)
+
+	tests := []struct {
+		name     string
+		groups   interface{}
+		delim    string
+		expected []string
+	}{
+		{"list", []interface{}{"foo", "bar baz"}, "", []string{"foo", "bar baz"}},
+		{"single string", "foo", "", []string{"foo"}},
+		{"whitespace delimited", "foo  bar\tbaz", "", []string{"foo", "bar", "baz"}},
+		{"comma delimited", "foo, bar,baz", ",", []string{"foo", "bar", "baz"}},
+		{"list with delimiter", []interface{}{"foo,bar"}, ",", []string{"foo,bar"}},
+	}
+
+	for _, test := range tests {
+		role := &jwtRole{
+			UserClaim:        "user",
+			GroupsClaims:     []string{"groups"},
+			GroupsClaimDelim: test.delim,
+		}
+		allClaims := map[string]interface{}{
+			"user":   "jeff",
+			"groups": test.groups,
+		}
+
+		_, groupAliases, err := b.(*jwtAuthBackend).createIdentity(allClaims, role)
+		if err != nil {
+			t.Fatalf("case %q: unexpected error: %v", test.name, err)
+		}
+
+		var actual []string
+		for _, alias := range groupAliases {
+			actual = append(actual, alias.Name)
+		}
+		if diff := deep.Equal(actual, test.expected); diff != nil {
+			t.Fatalf("case %q: %v", test.name, diff)
+		}
+	}
+}
+
+func TestLogin_JWKS(t *testing.T) {
+	b, storage := getBackend(t)
+
+	s := newJWKSServer(t, "key-1")
+	defer s.server.Close()
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"jwks_url":     s.server.URL + "/certs",
+			"bound_issuer": "https://team-vault.auth0.com/",
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/plugin-test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_type":       "jwt",
+			"user_claim":      "https://vault/user",
+			"bound_audiences": "https://vault.plugin.auth.jwt.test",
+			"policies":        "test",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	cl := jwt.Claims{
+		Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+		Issuer:    "https://team-vault.auth0.com/",
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+		Audience:  jwt.Audience{"https://vault.plugin.auth.jwt.test"},
+	}
+
+	privateCl := struct {
+		User string `json:"https://vault/user"`
+	}{
+		"jeff",
+	}
+
+	login := func(jwtData string) *logical.Response {
+		t.Helper()
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  jwtData,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil {
+			t.Fatal("got nil response")
+		}
+		return resp
+	}
+
+	jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+	resp = login(jwtData)
+	if resp.IsError() {
+		t.Fatalf("got error: %v", resp.Error())
+	}
+	if resp.Auth.Alias.Name != "jeff" {
+		t.Fatalf("unexpected alias name: %q", resp.Auth.Alias.Name)
+	}
+
+	// A token signed by another key is rejected.
+	jwtData, _ = getTestJWT(t, badPrivKey, cl, privateCl)
+	resp = login(jwtData)
+	if !resp.IsError() || !strings.Contains(resp.Error().Error(), "error verifying token signature") {
+		t.Fatalf("expected signature error, got: %#v", resp)
+	}
+}
+
+func TestLogin_JWT_SupportedAlgs(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPubKeyDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPubKey := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: rsaPubKeyDER,
+	}))
+
+	cl := jwt.Claims{
+		Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+		Issuer:    "https://team-vault.auth0.com/",
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+	}
+
+	privateCl := struct {
+		User string `json:"https://vault/user"`
+	}{
+		"jeff",
+	}
+
+	esToken, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS384, Key: rsaKey}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsToken, err := jwt.Signed(sig).Claims(cl).Claims(privateCl).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		algs     []string
+		roleAlgs []string
+		token    string
+		errMsg   string
+	}{
+		{[]string{"ES256", "RS384"}, nil, esToken, ""},
+		{[]string{"ES256", "RS384"}, nil, rsToken, ""},
+		{[]string{"RS384"}, nil, esToken, "unsupported signing algorithm: ES256"},
+		{[]string{"ES256"}, nil, rsToken, "unsupported signing algorithm: RS384"},
+		{[]string{"ES512", "RS512"}, nil, esToken, "unsupported signing algorithm: ES256"},
+
+		// the role's algorithms narrow those allowed by the config
+		{[]string{"ES256", "RS384"}, []string{"RS384"}, esToken, "unsupported signing algorithm: ES256"},
+		{[]string{"ES256", "RS384"}, []string{"RS384"}, rsToken, ""},
+		{[]string{"ES256", "RS384"}, []string{"ES256", "PS256"}, esToken, ""},
+		{nil, []string{"ES256"}, rsToken, "unsupported signing algorithm: RS384"},
+		{nil, []string{"ES256"}, esToken, ""},
+		{[]string{"RS384"}, []string{"ES256"}, esToken, "none of the role's supported signing algorithms are allowed by the config"},
+	}
+
+	for i, test := range tests {
+		b, storage := getBackend(t)
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"jwt_validation_pubkeys": []string{ecdsaPubKey, rsaPubKey},
+				"jwt_supported_algs":     test.algs,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+
+		req = &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "role/plugin-test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role_type":     "jwt",
+				"bound_subject": "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+				"user_claim":    "https://vault/user",
+				"policies":      "test",
+			},
+		}
+		if test.roleAlgs != nil {
+			req.Data["jwt_supported_algs"] = test.roleAlgs
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  test.token,
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil {
+			t.Fatalf("case %d: got nil response", i)
+		}
+
+		if test.errMsg == "" {
+			if resp.IsError() {
+				t.Fatalf("case %d: got error: %v", i, resp.Error())
+			}
+			continue
+		}
+		if !resp.IsError() || resp.Error().Error() != test.errMsg {
+			t.Fatalf("case %d: expected error %q, got: %#v", i, test.errMsg, resp)
+		}
+	}
+}
+
+func TestLogin_JWT_NoneAlg(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(
+		`{"sub":"r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients","iss":"https://team-vault.auth0.com/","nbf":%d,"https://vault/user":"jeff"}`,
+		time.Now().Add(-5*time.Second).Unix(),
+	)))
+	token := header + "." + payload + "."
+
+	b, storage := setupBackend(t, false, false, false)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role": "plugin-test",
+			"jwt":  token,
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected error, got: %#v", resp)
+	}
+	if !strings.Contains(resp.Error().Error(), "'none' algorithm are not allowed") {
+		t.Fatalf("unexpected error: %v", resp.Error())
+	}
+
+	// OIDC tokens are rejected before the provider is contacted.
+	_, err = b.(*jwtAuthBackend).verifyOIDCToken(context.Background(), &jwtConfig{}, &jwtRole{}, token)
+	if err == nil || !strings.Contains(err.Error(), "'none' algorithm are not allowed") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLogin_UserClaimTemplate(t *testing.T) {
+	b, storage := getBackend(t)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"jwt_validation_pubkeys": ecdsaPubKey,
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/plugin-test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_type":           "jwt",
+			"bound_subject":       "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+			"user_claim_template": "{{sub}}@{{tenant_id}}",
+			"policies":            "test",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	cl := jwt.Claims{
+		Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+	}
+
+	login := func(privateCl interface{}) *logical.Response {
+		t.Helper()
+		jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  jwtData,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil {
+			t.Fatal("got nil response")
+		}
+		return resp
+	}
+
+	resp = login(map[string]interface{}{"tenant_id": "acme"})
+	if resp.IsError() {
+		t.Fatalf("got error: %v", resp.Error())
+	}
+	if resp.Auth.Alias.Name != "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients@acme" {
+		t.Fatalf("unexpected alias name: %q", resp.Auth.Alias.Name)
+	}
+
+	// Claims referenced by the template must be present.
+	resp = login(struct{}{})
+	if !resp.IsError() || resp.Error().Error() != `error rendering user_claim_template: claim "tenant_id" not found in token` {
+		t.Fatalf("expected error, got: %#v", resp)
+	}
+}
+
+func TestLogin_UserClaimPointer(t *testing.T) {
+	b, storage := getBackend(t)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"jwt_validation_pubkeys": ecdsaPubKey,
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	cl := jwt.Claims{
+		Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+		NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+	}
+	privateCl := map[string]interface{}{
+		"profile": map[string]interface{}{
+			"id":  "jeff-123",
+			"age": 42,
+		},
+	}
+
+	login := func(userClaim string) *logical.Response {
+		t.Helper()
+		req := &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "role/plugin-test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role_type":     "jwt",
+				"bound_subject": "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+				"user_claim":    userClaim,
+				"policies":      "test",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+
+		jwtData, _ := getTestJWT(t, ecdsaPrivKey, cl, privateCl)
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role": "plugin-test",
+				"jwt":  jwtData,
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil {
+			t.Fatal("got nil response")
+		}
+		return resp
+	}
+
+	resp = login("/profile/id")
+	if resp.IsError() {
+		t.Fatalf("got error: %v", resp.Error())
+	}
+	if resp.Auth.Alias.Name != "jeff-123" {
+		t.Fatalf("unexpected alias name: %q", resp.Auth.Alias.Name)
+	}
+
+	resp = login("/profile/age")
+	if !resp.IsError() || resp.Error().Error() != `claim "/profile/age" could not be converted to string` {
+		t.Fatalf("expected error, got: %#v", resp)
+	}
+
+	resp = login("/profile/missing")
+	if !resp.IsError() || resp.Error().Error() != `claim "/profile/missing" not found in token` {
+		t.Fatalf("expected error, got: %#v", resp)
 	}
 }
 
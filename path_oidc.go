@@ -2,8 +2,16 @@ package jwtauth
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,26 +19,99 @@ import (
 
 	"github.com/coreos/go-oidc"
 	"github.com/hashicorp/errwrap"
+	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
+// oidcStateTimeout is the default lifetime of an OIDC login state.
 var oidcStateTimeout = 10 * time.Minute
 
+// Placeholders used in place of the generated values of previewed auth URLs.
+const (
+	previewState         = "{state}"
+	previewNonce         = "{nonce}"
+	previewCodeChallenge = "{code_challenge}"
+)
+
+// clientAssertionType identifies a JWT client assertion, as used by the
+// private_key_jwt client authentication method.
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionTTL is the lifetime of client assertions.
+const clientAssertionTTL = 5 * time.Minute
+
+// Number of random bytes used to generate OAuth states and OIDC nonces, by
+// default and at minimum.
+const (
+	defaultOIDCRandomLength = 20
+	minOIDCRandomLength     = 16
+)
+
 // OIDC error prefixes. These are searched for specifically by the UI, so any
 // changes to them must be aligned with a UI change.
 const errLoginFailed = "Vault login failed."
 const errNoResponse = "No response from provider."
 const errTokenVerification = "Token verification failed."
 
+// OIDC response modes that may be requested for the authorization response.
+const (
+	responseModeQuery    = "query"
+	responseModeFormPost = "form_post"
+)
+
+// errorCodeHeader carries a machine-readable code on callback error responses,
+// so that front-ends can branch on the failure without parsing the message. The
+// code can't be added to the response data, as Vault only treats responses
+// whose data holds nothing but the error message as errors. Vault strips
+// plugin response headers that the mount does not allow, so the header must be
+// added to the mount's allowed_response_headers to reach clients.
+const errorCodeHeader = "X-Vault-Error-Code"
+
+// Codes returned in the errorCodeHeader of callback error responses.
+const (
+	errCodeStateExpired     = "state_expired"
+	errCodeConfigMissing    = "config_missing"
+	errCodeCodeMissing      = "code_missing"
+	errCodeExchangeFailed   = "exchange_failed"
+	errCodeIDTokenMissing   = "id_token_missing"
+	errCodeRoleNotFound     = "role_not_found"
+	errCodeNoRoleMatched    = "no_role_matched"
+	errCodeRoleNotAllowed   = "role_not_allowed"
+	errCodeRoleMismatch     = "role_mismatch"
+	errCodeTokenInvalid     = "token_invalid"
+	errCodeNonceMismatch    = "nonce_mismatch"
+	errCodeUserInfoFailed   = "userinfo_failed"
+	errCodeUserInfoMismatch = "userinfo_sub_mismatch"
+	errCodeEmailUnverified  = "email_not_verified"
+	errCodeBoundClaimFailed = "bound_claim_failed"
+	errCodeIdentityFailed   = "identity_failed"
+)
+
+// Value of the groups_source token metadata for groups read from the token's
+// groups_claim.
+const groupsSourceClaim = "claim"
+
 // oidcState is created when an authURL is requested. The state identifier is
 // passed throughout the OAuth process.
 type oidcState struct {
-	rolename    string
-	nonce       string
-	redirectURI string
+	// roleNames are tried in order during the callback. There is a single
+	// role unless the login was started using the default_roles chain, or the
+	// role is selected through the role_claim.
+	roleNames    []string
+	nonce        string
+	redirectURI  string
+	codeVerifier string
+
+	// roleFromClaim is set if the role is selected from roleNames using the
+	// role_claim of the ID token.
+	roleFromClaim bool
+
+	createdAt time.Time
 }
 
 func pathOIDC(b *jwtAuthBackend) []*framework.Path {
@@ -44,6 +125,14 @@ func pathOIDC(b *jwtAuthBackend) []*framework.Path {
 				"code": {
 					Type: framework.TypeString,
 				},
+				"id_token": {
+					Type:        framework.TypeString,
+					Description: "An ID token posted by the provider alongside the code. It is ignored; the ID token obtained from the code exchange is used instead.",
+				},
+				"role": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "The role the client expects the login to complete with. Optional; if set, it must be a role the login was started with. The role can never be changed during the callback.",
+				},
 			},
 
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -51,6 +140,12 @@ func pathOIDC(b *jwtAuthBackend) []*framework.Path {
 					Callback: b.pathCallback,
 					Summary:  "Callback endpoint to complete an OIDC login.",
 				},
+				// Providers using the form_post response mode deliver the
+				// authorization response as a POST.
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathCallback,
+					Summary:  "Callback endpoint to complete an OIDC login using the form_post response mode.",
+				},
 			},
 		},
 		{
@@ -64,6 +159,10 @@ func pathOIDC(b *jwtAuthBackend) []*framework.Path {
 					Type:        framework.TypeString,
 					Description: "The OAuth redirect_uri to use in the authorization URL.",
 				},
+				"preview": {
+					Type:        framework.TypeBool,
+					Description: "If set, the authorization URL is returned with placeholders in place of the state, nonce and PKCE code challenge, and no login state is stored.",
+				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
 				logical.UpdateOperation: &framework.PathOperation{
@@ -72,78 +171,496 @@ func pathOIDC(b *jwtAuthBackend) []*framework.Path {
 				},
 			},
 		},
+		{
+			Pattern: `oidc/logout_url`,
+			Fields: map[string]*framework.FieldSchema{
+				"role": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "The role whose allowed_redirect_uris the post_logout_redirect_uri is validated against. Defaults to the default role(s).",
+				},
+				"id_token_hint": {
+					Type:        framework.TypeString,
+					Description: "The ID token previously issued to the user, passed to the provider as a hint about the session to end.",
+				},
+				"post_logout_redirect_uri": {
+					Type:        framework.TypeString,
+					Description: "Where the provider should redirect the user after logout. It must be allowed by the role's allowed_redirect_uris.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.logoutURL,
+					Summary:  "Request a URL at the provider's end_session_endpoint to end the user's OIDC session.",
+				},
+			},
+		},
+		{
+			Pattern: `oidc/discovery`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathDiscoveryRead,
+					Summary:  "Read the provider metadata resolved from the OIDC discovery URL.",
+				},
+			},
+		},
+		{
+			Pattern: `oidc/test`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathOIDCTest,
+					Summary:  "Check that the configured provider can be reached and its signing keys fetched.",
+				},
+			},
+		},
+		{
+			Pattern: `oidc/state/` + framework.GenericNameRegex("state"),
+			Fields: map[string]*framework.FieldSchema{
+				"state": {
+					Type:        framework.TypeString,
+					Description: "The OAuth state of the pending login to cancel.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathStateDelete,
+					Summary:  "Cancel a pending OIDC login by deleting its OAuth state.",
+				},
+			},
+		},
+		{
+			Pattern: `oidc/states`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathStatesRead,
+					Summary:  "Report the number and ages of pending OIDC logins.",
+				},
+			},
+		},
 	}
 }
 
-func (b *jwtAuthBackend) pathCallback(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	state := b.verifyState(d.Get("state").(string))
-	if state == nil {
-		return logical.ErrorResponse(errLoginFailed + " Expired or missing OAuth state."), nil
+// pathDiscoveryRead returns the endpoints the backend resolved from the
+// provider's discovery document.
+func (b *jwtAuthBackend) pathDiscoveryRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || config.OIDCDiscoveryURL == "" {
+		return logical.ErrorResponse("'oidc_discovery_url' is not configured"), nil
 	}
 
-	roleName := state.rolename
-	role, err := b.role(ctx, req.Storage, roleName)
+	provider, err := b.getProvider(ctx, config)
+	if err != nil {
+		return logical.ErrorResponse(errwrap.Wrapf("error getting provider: {{err}}", err).Error()), nil
+	}
+
+	var metadata struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+		EndSessionEndpoint    string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, errwrap.Wrapf("error parsing provider metadata: {{err}}", err)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"issuer":                 metadata.Issuer,
+			"authorization_endpoint": metadata.AuthorizationEndpoint,
+			"token_endpoint":         metadata.TokenEndpoint,
+			"jwks_uri":               metadata.JWKSURI,
+			"userinfo_endpoint":      metadata.UserInfoEndpoint,
+			"end_session_endpoint":   metadata.EndSessionEndpoint,
+		},
+	}, nil
+}
+
+// logoutURL returns a URL at the provider's end_session_endpoint that performs
+// an RP-initiated logout, as described by OpenID Connect RP-Initiated Logout.
+func (b *jwtAuthBackend) logoutURL(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
-	if role == nil {
-		return logical.ErrorResponse(errLoginFailed + " Role could not be found"), nil
+	if config == nil || config.OIDCDiscoveryURL == "" {
+		return logical.ErrorResponse("'oidc_discovery_url' is not configured"), nil
+	}
+
+	provider, err := b.getProvider(ctx, config)
+	if err != nil {
+		return logical.ErrorResponse(errwrap.Wrapf("error getting provider: {{err}}", err).Error()), nil
+	}
+
+	var metadata struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, errwrap.Wrapf("error parsing provider metadata: {{err}}", err)
+	}
+	if metadata.EndSessionEndpoint == "" {
+		return logical.ErrorResponse("the provider does not advertise an end_session_endpoint"), nil
+	}
+
+	logoutURL, err := url.Parse(metadata.EndSessionEndpoint)
+	if err != nil {
+		return nil, errwrap.Wrapf("error parsing end_session_endpoint: {{err}}", err)
+	}
+
+	params := logoutURL.Query()
+	if idTokenHint := d.Get("id_token_hint").(string); idTokenHint != "" {
+		params.Set("id_token_hint", idTokenHint)
 	}
+	if redirectURI := d.Get("post_logout_redirect_uri").(string); redirectURI != "" {
+		roleNames := []string{d.Get("role").(string)}
+		if roleNames[0] == "" {
+			roleNames = config.defaultRoles()
+		}
 
+		allowed := false
+		for _, roleName := range roleNames {
+			role, err := b.role(ctx, req.Storage, roleName)
+			if err != nil {
+				return nil, err
+			}
+			if role != nil && (validRedirect(redirectURI, role.AllowedRedirectURIs) || (role.AllowAllRedirectURIs && validAnyRedirect(redirectURI))) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			b.Logger().Warn("unauthorized post_logout_redirect_uri", "post_logout_redirect_uri", redirectURI, "roles", roleNames)
+			return logical.ErrorResponse("unauthorized post_logout_redirect_uri: %s", redirectURI), nil
+		}
+
+		params.Set("post_logout_redirect_uri", redirectURI)
+	}
+	if config.OIDCClientID != "" {
+		params.Set("client_id", config.OIDCClientID)
+	}
+	logoutURL.RawQuery = params.Encode()
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"logout_url": logoutURL.String(),
+		},
+	}, nil
+}
+
+// pathOIDCTest performs discovery and fetches the signing keys using the
+// stored config, without using or replacing the cached provider, so that
+// connectivity and CA settings can be checked before any user logs in. The
+// first failing step is reported as an error.
+func (b *jwtAuthBackend) pathOIDCTest(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	config, err := b.config(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 	if config == nil {
-		return logical.ErrorResponse(errLoginFailed + " Could not load configuration"), nil
+		return logical.ErrorResponse("could not load configuration"), nil
 	}
 
-	provider, err := b.getProvider(ctx, config)
+	if len(config.JWTValidationPubKeys) != 0 {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"keys": len(config.ParsedJWTPubKeys),
+			},
+		}, nil
+	}
+
+	oidcCtx, err := b.createOIDCContext(b.providerCtx, config)
 	if err != nil {
-		return nil, errwrap.Wrapf(errLoginFailed+" Error getting provider for login operation: {{err}}", err)
+		return logical.ErrorResponse(errwrap.Wrapf("error creating HTTP client: {{err}}", err).Error()), nil
 	}
 
-	var oauth2Config = oauth2.Config{
-		ClientID:     config.OIDCClientID,
-		ClientSecret: config.OIDCClientSecret,
-		RedirectURL:  state.redirectURI,
-		Endpoint:     provider.Endpoint(),
-		Scopes:       []string{oidc.ScopeOpenID},
+	data := map[string]interface{}{}
+	jwksURL := config.JWKSURL
+	if config.OIDCDiscoveryURL != "" {
+		provider, err := oidc.NewProvider(oidcCtx, config.OIDCDiscoveryURL)
+		if err != nil {
+			return logical.ErrorResponse(errwrap.Wrapf("error performing discovery: {{err}}", err).Error()), nil
+		}
+
+		var metadata struct {
+			Issuer                string `json:"issuer"`
+			AuthorizationEndpoint string `json:"authorization_endpoint"`
+			TokenEndpoint         string `json:"token_endpoint"`
+			JWKSURI               string `json:"jwks_uri"`
+		}
+		if err := provider.Claims(&metadata); err != nil {
+			return logical.ErrorResponse(errwrap.Wrapf("error parsing provider metadata: {{err}}", err).Error()), nil
+		}
+
+		var missing []string
+		if metadata.AuthorizationEndpoint == "" {
+			missing = append(missing, "authorization_endpoint")
+		}
+		if metadata.TokenEndpoint == "" {
+			missing = append(missing, "token_endpoint")
+		}
+		if metadata.JWKSURI == "" {
+			missing = append(missing, "jwks_uri")
+		}
+		if len(missing) > 0 {
+			return logical.ErrorResponse("provider metadata is missing: %s", strings.Join(missing, ", ")), nil
+		}
+
+		data["issuer"] = metadata.Issuer
+		jwksURL = metadata.JWKSURI
+	}
+
+	keys, err := newJWKSKeySet(oidcCtx, jwksURL, 0).fetch()
+	if err != nil {
+		return logical.ErrorResponse(errwrap.Wrapf("error fetching JWKS: {{err}}", err).Error()), nil
+	}
+	if len(keys) == 0 {
+		return logical.ErrorResponse("no keys found at %s", jwksURL), nil
+	}
+
+	data["jwks_url"] = jwksURL
+	data["keys"] = len(keys)
+
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+// pathStateDelete removes a pending OAuth state so that it can no longer be
+// used to complete a login. Deleting an unknown or expired state succeeds.
+func (b *jwtAuthBackend) pathStateDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.oidcStates.Delete(d.Get("state").(string))
+	return nil, nil
+}
+
+// stateAgeBuckets are the upper bounds of the age buckets reported for pending
+// OIDC logins. Older states are counted in a final, unbounded bucket.
+var stateAgeBuckets = []struct {
+	name  string
+	limit time.Duration
+}{
+	{"under_1m", time.Minute},
+	{"1m_to_5m", 5 * time.Minute},
+	{"5m_to_10m", 10 * time.Minute},
+}
+
+const stateAgeBucketOver = "over_10m"
+
+// pathStatesRead reports how many OIDC logins are pending and how long ago
+// they were started. The states and nonces themselves are never returned.
+func (b *jwtAuthBackend) pathStatesRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	buckets := map[string]int{stateAgeBucketOver: 0}
+	for _, bucket := range stateAgeBuckets {
+		buckets[bucket.name] = 0
+	}
+
+	now := time.Now()
+	count := 0
+	var oldest time.Duration
+	for _, item := range b.oidcStates.Items() {
+		state, ok := item.Object.(*oidcState)
+		if !ok {
+			continue
+		}
+		count++
+
+		age := now.Sub(state.createdAt)
+		if age > oldest {
+			oldest = age
+		}
+
+		bucketName := stateAgeBucketOver
+		for _, bucket := range stateAgeBuckets {
+			if age < bucket.limit {
+				bucketName = bucket.name
+				break
+			}
+		}
+		buckets[bucketName]++
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"count":       count,
+			"age_buckets": buckets,
+			"oldest_age":  int64(oldest.Seconds()),
+		},
+	}, nil
+}
+
+// pathCallback completes an OIDC login. The authorization response parameters
+// arrive as query parameters, or as form data when the form_post response mode
+// is used. If a provider sends both a code and an id_token, only the code is
+// used and the ID token is obtained through the code exchange. The state is
+// always verified before anything else is considered.
+func (b *jwtAuthBackend) pathCallback(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	state := b.verifyState(d.Get("state").(string))
+	if state == nil {
+		return callbackErrorResponse(errCodeStateExpired, errLoginFailed+" Expired or missing OAuth state."), nil
+	}
+
+	// The roles bound to the state when the login was started are
+	// authoritative. A client submitting a different role is rejected rather
+	// than allowed to switch roles mid-flow.
+	if roleName := d.Get("role").(string); roleName != "" && !strutil.StrListContains(state.roleNames, roleName) {
+		b.Logger().Warn("callback role does not match the role the login was started with", "role", roleName, "state_roles", state.roleNames)
+		return callbackErrorResponse(errCodeRoleMismatch, errLoginFailed+" Role %q does not match the role the login was started with.", roleName), nil
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return callbackErrorResponse(errCodeConfigMissing, errLoginFailed+" Could not load configuration"), nil
+	}
+
+	provider, err := b.getProvider(ctx, config)
+	if err != nil {
+		return nil, errwrap.Wrapf(errLoginFailed+" Error getting provider for login operation: {{err}}", err)
 	}
 
 	code := d.Get("code").(string)
 	if code == "" {
-		return logical.ErrorResponse(errLoginFailed + " OAuth code parameter not provided"), nil
+		return callbackErrorResponse(errCodeCodeMissing, errLoginFailed+" OAuth code parameter not provided"), nil
+	}
+
+	oidcCtx, err := b.createOIDCContext(ctx, config)
+	if err != nil {
+		return nil, errwrap.Wrapf(errLoginFailed+" Error preparing context for login operation: {{err}}", err)
 	}
 
-	oauth2Token, err := oauth2Config.Exchange(ctx, code)
+	oauth2Token, err := b.exchangeCode(oidcCtx, config, provider, state, code)
+	if err != nil && staleEndpointError(err) {
+		// The provider may have moved its endpoints since discovery was
+		// performed, so retry once against freshly discovered metadata.
+		if refreshed, ok := b.rediscoverProvider(config, provider); ok {
+			b.Logger().Warn("retrying code exchange with re-discovered provider metadata", "error", err)
+			provider = refreshed
+			oauth2Token, err = b.exchangeCode(oidcCtx, config, provider, state, code)
+		}
+	}
 	if err != nil {
-		return logical.ErrorResponse(errLoginFailed+" Error exchanging oidc code: %q.", err.Error()), nil
+		return callbackErrorResponse(errCodeExchangeFailed, errLoginFailed+" Error exchanging oidc code: %q.", err.Error()), nil
 	}
 
 	// Extract the ID Token from OAuth2 token.
 	rawToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok {
-		return logical.ErrorResponse(errTokenVerification + " No id_token found in response."), nil
+		return callbackErrorResponse(errCodeIDTokenMissing, errTokenVerification+" No id_token found in response."), nil
+	}
+
+	roleNames := state.roleNames
+	if state.roleFromClaim {
+		roleName, err := selectRoleFromClaim(b.Logger(), config, rawToken, state.roleNames)
+		if err != nil {
+			return callbackErrorResponse(errCodeRoleNotAllowed, errLoginFailed+" %s", err.Error()), nil
+		}
+		roleNames = []string{roleName}
+	}
+
+	// A login started from the default_roles chain completes with the first
+	// role whose constraints the token satisfies. The failures of all roles
+	// are reported if none match.
+	var failures []string
+	for _, roleName := range roleNames {
+		resp, err := b.callbackRole(ctx, req, config, provider, oidcCtx, state, oauth2Token, rawToken, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if len(roleNames) == 1 || !resp.IsError() {
+			return resp, nil
+		}
+
+		b.Logger().Debug("default role did not match", "role", roleName, "error", resp.Error())
+		failures = append(failures, fmt.Sprintf("%s: %s", roleName, resp.Error()))
+	}
+
+	return callbackErrorResponse(errCodeNoRoleMatched, errLoginFailed+" No default role matched: %s", strings.Join(failures, "; ")), nil
+}
+
+// selectRoleFromClaim returns the role named by the role_claim of the ID token, which
+// must be one of allowedRoles. The token is verified against the selected role
+// afterwards, so its claims may be read without verification here.
+func selectRoleFromClaim(logger log.Logger, config *jwtConfig, rawToken string, allowedRoles []string) (string, error) {
+	parsedJWT, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return "", errwrap.Wrapf("error parsing token: {{err}}", err)
+	}
+
+	allClaims := make(map[string]interface{})
+	if err := parsedJWT.UnsafeClaimsWithoutVerification(&allClaims); err != nil {
+		return "", errwrap.Wrapf("error parsing claims: {{err}}", err)
+	}
+	if err := applyClaimTypeHints(allClaims, config.ClaimTypeHints); err != nil {
+		return "", err
+	}
+
+	roleName, ok := getClaim(logger, allClaims, config.RoleClaim).(string)
+	if !ok || roleName == "" {
+		return "", fmt.Errorf("the %q claim does not name a role", config.RoleClaim)
+	}
+
+	roleName = strings.ToLower(roleName)
+	if !strutil.StrListContains(allowedRoles, roleName) {
+		return "", fmt.Errorf("role %q selected by the %q claim is not allowed", roleName, config.RoleClaim)
+	}
+
+	return roleName, nil
+}
+
+// callbackRole validates the ID token obtained during the callback against a
+// role and returns the login response for that role.
+func (b *jwtAuthBackend) callbackRole(ctx context.Context, req *logical.Request, config *jwtConfig, provider *oidc.Provider, oidcCtx context.Context, state *oidcState, oauth2Token *oauth2.Token, rawToken, roleName string) (*logical.Response, error) {
+	role, err := b.role(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return callbackErrorResponse(errCodeRoleNotFound, errLoginFailed+" Role could not be found"), nil
 	}
 
 	// Parse and verify ID Token payload.
 	allClaims, err := b.verifyOIDCToken(ctx, config, role, rawToken)
 	if err != nil {
-		return logical.ErrorResponse("%s %s", errTokenVerification, err.Error()), nil
+		return callbackErrorResponse(errCodeTokenInvalid, "%s %s", errTokenVerification, err.Error()), nil
 	}
 
-	if allClaims["nonce"] != state.nonce {
-		return logical.ErrorResponse(errTokenVerification + " Invalid ID token nonce."), nil
+	if !role.OIDCSkipNonce && allClaims["nonce"] != state.nonce {
+		return callbackErrorResponse(errCodeNonceMismatch, errTokenVerification+" Invalid ID token nonce."), nil
 	}
 	delete(allClaims, "nonce")
 
+	if len(role.BoundACR) > 0 {
+		if err := validateACR(allClaims, role.BoundACR); err != nil {
+			return b.claimsErrorResponse(config, allClaims, errCodeTokenInvalid, "%s %s", errTokenVerification, err.Error()), nil
+		}
+	}
+
+	if role.OIDCMaxAge > 0 {
+		if err := validateAuthTime(allClaims, role.OIDCMaxAge, config.ClockSkewLeeway, time.Now()); err != nil {
+			return b.claimsErrorResponse(config, allClaims, errCodeTokenInvalid, "%s %s", errTokenVerification, err.Error()), nil
+		}
+	}
+
 	// Attempt to fetch information from the /userinfo endpoint and merge it with
-	// the existing claims data. A failure to fetch additional information from this
-	// endpoint will not invalidate the authorization flow.
-	if userinfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(oauth2Token)); err == nil {
-		_ = userinfo.Claims(&allClaims)
-	} else {
+	// the existing claims data. Unless the role requires userinfo data, a failure
+	// to fetch additional information from this endpoint will not invalidate the
+	// authorization flow. The endpoint is never called if it is disabled.
+	if config.OIDCDisableUserInfo {
+		if role.OIDCFetchUserInfo {
+			return b.claimsErrorResponse(config, allClaims, errCodeUserInfoFailed, errLoginFailed+" The role requires userinfo, but the userinfo endpoint is disabled."), nil
+		}
+	} else if err := fetchUserInfo(oidcCtx, provider, oauth2Token, allClaims, role.UserInfoClaims); err != nil {
+		if err == errUserInfoSubMismatch {
+			return b.claimsErrorResponse(config, allClaims, errCodeUserInfoMismatch, errTokenVerification+" %s.", err.Error()), nil
+		}
+		if role.OIDCFetchUserInfo {
+			return b.claimsErrorResponse(config, allClaims, errCodeUserInfoFailed, errLoginFailed+" Error fetching userinfo: %s", err.Error()), nil
+		}
+
 		logFunc := b.Logger().Warn
 		if strings.Contains(err.Error(), "user info endpoint is not supported") {
 			logFunc = b.Logger().Info
@@ -151,13 +668,43 @@ func (b *jwtAuthBackend) pathCallback(ctx context.Context, req *logical.Request,
 		logFunc("error reading /userinfo endpoint", "error", err)
 	}
 
-	if err := validateBoundClaims(b.Logger(), role.BoundClaims, allClaims); err != nil {
-		return logical.ErrorResponse("error validating claims: %s", err.Error()), nil
+	if err := applyClaimTypeHints(allClaims, config.ClaimTypeHints); err != nil {
+		return b.claimsErrorResponse(config, allClaims, errCodeTokenInvalid, "error validating claims: %s", err.Error()), nil
+	}
+
+	if role.OIDCRequireEmailVerified && !emailVerified(allClaims) {
+		return b.claimsErrorResponse(config, allClaims, errCodeEmailUnverified, errTokenVerification+" The email_verified claim must be true."), nil
+	}
+
+	// Providers may put authorization data in the access token rather than
+	// the ID token, so the role can have its bound claims checked against it.
+	boundClaimsSource := allClaims
+	if role.BoundClaimsToken == boundClaimsTokenAccess {
+		accessClaims, err := b.verifyAccessToken(ctx, config, role, provider, oauth2Token.AccessToken)
+		if err != nil {
+			return b.claimsErrorResponse(config, allClaims, errCodeTokenInvalid, "%s %s", errTokenVerification, err.Error()), nil
+		}
+		if err := applyClaimTypeHints(accessClaims, config.ClaimTypeHints); err != nil {
+			return b.claimsErrorResponse(config, allClaims, errCodeTokenInvalid, "error validating access token claims: %s", err.Error()), nil
+		}
+		boundClaimsSource = accessClaims
+	}
+
+	if err := validateBoundClaims(b.Logger(), role.BoundClaimsType, role.BoundClaims, boundClaimsSource); err != nil {
+		return b.claimsErrorResponse(config, allClaims, errCodeBoundClaimFailed, "error validating claims: %s", err.Error()), nil
+	}
+
+	if err := validateForbiddenClaims(b.Logger(), role.ForbiddenClaims, allClaims); err != nil {
+		return b.claimsErrorResponse(config, allClaims, errCodeBoundClaimFailed, "error validating claims: %s", err.Error()), nil
+	}
+
+	if err := validateRequiredClaims(b.Logger(), role.RequiredClaims, allClaims); err != nil {
+		return b.claimsErrorResponse(config, allClaims, errCodeBoundClaimFailed, "error validating claims: %s", err.Error()), nil
 	}
 
 	alias, groupAliases, err := b.createIdentity(allClaims, role)
 	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		return b.claimsErrorResponse(config, allClaims, errCodeIdentityFailed, "%s", err.Error()), nil
 	}
 
 	tokenMetadata := map[string]string{"role": roleName}
@@ -165,6 +712,20 @@ func (b *jwtAuthBackend) pathCallback(ctx context.Context, req *logical.Request,
 		tokenMetadata[k] = v
 	}
 
+	// Record where the group aliases came from to help audit group-based
+	// policies. Groups are currently only sourced from the token's claims.
+	if len(role.GroupsClaims) != 0 {
+		tokenMetadata["groups_source"] = groupsSourceClaim
+		tokenMetadata["groups_count"] = strconv.Itoa(len(groupAliases))
+	}
+
+	if role.ExposeIDToken {
+		tokenMetadata["id_token"] = rawToken
+	}
+
+	internalData := authInternalData(roleName, role, allClaims)
+	ttl, maxTTL := role.leaseTTLs(internalData)
+
 	resp := &logical.Response{
 		Auth: &logical.Auth{
 			Policies:     role.Policies,
@@ -173,14 +734,12 @@ func (b *jwtAuthBackend) pathCallback(ctx context.Context, req *logical.Request,
 			NumUses:      role.NumUses,
 			Alias:        alias,
 			GroupAliases: groupAliases,
-			InternalData: map[string]interface{}{
-				"role": roleName,
-			},
-			Metadata: tokenMetadata,
+			InternalData: internalData,
+			Metadata:     tokenMetadata,
 			LeaseOptions: logical.LeaseOptions{
 				Renewable: true,
-				TTL:       role.TTL,
-				MaxTTL:    role.MaxTTL,
+				TTL:       ttl,
+				MaxTTL:    maxTTL,
 			},
 			BoundCIDRs: role.BoundCIDRs,
 		},
@@ -189,8 +748,123 @@ func (b *jwtAuthBackend) pathCallback(ctx context.Context, req *logical.Request,
 	return resp, nil
 }
 
+// callbackErrorResponse returns an error response for the callback that
+// includes a machine-readable error code alongside the message.
+func callbackErrorResponse(code, format string, args ...interface{}) *logical.Response {
+	resp := logical.ErrorResponse(format, args...)
+	resp.Headers = map[string][]string{
+		errorCodeHeader: {code},
+	}
+	return resp
+}
+
+// claimsErrorResponse returns an error response for a login that was rejected
+// after the token's claims were received. If verbose_oidc_logging is enabled,
+// the received claims are logged at debug level to help diagnose the failure.
+func (b *jwtAuthBackend) claimsErrorResponse(config *jwtConfig, allClaims map[string]interface{}, code, format string, args ...interface{}) *logical.Response {
+	resp := callbackErrorResponse(code, format, args...)
+	if config.VerboseOIDCLogging {
+		b.Logger().Debug("OIDC login failed", "error", resp.Error(), "claims", allClaims)
+	}
+	return resp
+}
+
+// fetchUserInfo queries the provider's /userinfo endpoint and merges the returned
+// claims into allClaims. Claims already present in allClaims (i.e. from the ID
+// token) take precedence over userinfo claims of the same name.
+func fetchUserInfo(ctx context.Context, provider *oidc.Provider, token *oauth2.Token, allClaims map[string]interface{}, allowedClaims []string) error {
+	userinfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return err
+	}
+
+	// The userinfo response may only be used if it describes the subject of
+	// the ID token (OpenID Connect Core, section 5.3.2).
+	if userinfo.Subject == "" {
+		return errors.New("userinfo response is missing the sub claim")
+	}
+	if sub, _ := allClaims["sub"].(string); userinfo.Subject != sub {
+		return errUserInfoSubMismatch
+	}
+
+	userinfoClaims := make(map[string]interface{})
+	if err := userinfo.Claims(&userinfoClaims); err != nil {
+		return err
+	}
+
+	for k, v := range userinfoClaims {
+		if len(allowedClaims) > 0 && !strutil.StrListContains(allowedClaims, k) {
+			continue
+		}
+		if _, ok := allClaims[k]; !ok {
+			allClaims[k] = v
+		}
+	}
+
+	return nil
+}
+
+// errUserInfoSubMismatch is returned when the userinfo response belongs to a
+// different subject than the ID token, which may indicate a substituted token.
+var errUserInfoSubMismatch = errors.New("userinfo sub claim does not match the ID token")
+
+// emailVerified reports whether the 'email_verified' claim is true. Some
+// providers send the claim as a string rather than a boolean.
+func emailVerified(allClaims map[string]interface{}) bool {
+	switch v := allClaims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		verified, _ := strconv.ParseBool(v)
+		return verified
+	}
+	return false
+}
+
+// validateAuthTime checks that the end-user authenticated with the provider no
+// longer than maxAge before now, based on the 'auth_time' claim. The leeway
+// allows for clock drift, as for the token's other time claims.
+func validateAuthTime(allClaims map[string]interface{}, maxAge, leeway time.Duration, now time.Time) error {
+	var authTime int64
+	switch v := allClaims["auth_time"].(type) {
+	case float64:
+		authTime = int64(v)
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return fmt.Errorf("auth_time claim is not a valid timestamp: %s", v)
+		}
+		authTime = i
+	case nil:
+		return errors.New("auth_time claim is required when max_age is set")
+	default:
+		return fmt.Errorf("auth_time claim is not a valid timestamp: %v", v)
+	}
+
+	if now.Sub(time.Unix(authTime, 0)) > maxAge+leeway {
+		return errors.New("authentication is older than max_age, re-authentication is required")
+	}
+
+	return nil
+}
+
+// validateACR checks that the 'acr' claim matches one of the allowed values.
+func validateACR(allClaims map[string]interface{}, allowed []string) error {
+	acr, ok := allClaims["acr"].(string)
+	if !ok {
+		return fmt.Errorf("acr claim is missing, expected one of %q", allowed)
+	}
+
+	if !strutil.StrListContains(allowed, acr) {
+		return fmt.Errorf("acr claim does not match: expected one of %q, got %q", allowed, acr)
+	}
+
+	return nil
+}
+
 // authURL returns a URL used for redirection to receive an authorization code.
-// This path requires a role name, or that a default_role has been configured.
+// This path requires a role name, or that a default_role or default_roles has
+// been configured.
 // Because this endpoint is unauthenticated, the response to invalid or non-OIDC
 // roles is intentionally non-descriptive and will simply be an empty string.
 func (b *jwtAuthBackend) authURL(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -214,11 +888,19 @@ func (b *jwtAuthBackend) authURL(ctx context.Context, req *logical.Request, d *f
 		return resp, nil
 	}
 
-	roleName := d.Get("role").(string)
-	if roleName == "" {
-		roleName = config.DefaultRole
+	roleNames := []string{d.Get("role").(string)}
+	if roleNames[0] == "" {
+		roleNames = config.defaultRoles()
+	}
+
+	// Without a role, the ID token may select one of the allowed roles through
+	// the role_claim. Those that allow the redirect URI are kept in the state.
+	roleFromClaim := false
+	if len(roleNames) == 0 && config.RoleClaim != "" {
+		roleNames = config.RoleClaimAllowedRoles
+		roleFromClaim = true
 	}
-	if roleName == "" {
+	if len(roleNames) == 0 {
 		return logical.ErrorResponse("missing role"), nil
 	}
 
@@ -227,17 +909,34 @@ func (b *jwtAuthBackend) authURL(ctx context.Context, req *logical.Request, d *f
 		return logical.ErrorResponse("missing redirect_uri"), nil
 	}
 
-	role, err := b.role(ctx, req.Storage, roleName)
-	if err != nil {
-		return resp, nil
-	}
+	// Only OIDC roles that allow the redirect URI can complete the login. The
+	// first of them determines the parameters of the auth URL, so later roles
+	// are only kept if they would request the same parameters.
+	var role *jwtRole
+	var candidates []string
+	for _, roleName := range roleNames {
+		r, err := b.role(ctx, req.Storage, roleName)
+		if err != nil || r == nil || r.RoleType != "oidc" {
+			continue
+		}
 
-	if role == nil || role.RoleType != "oidc" {
-		return resp, nil
-	}
+		if !validRedirect(redirectURI, r.AllowedRedirectURIs) {
+			if !r.AllowAllRedirectURIs || !validAnyRedirect(redirectURI) {
+				logger.Warn("unauthorized redirect_uri", "redirect_uri", redirectURI, "role", roleName)
+				continue
+			}
+			logger.Warn("redirect_uri allowed by allow_all_redirect_uris", "redirect_uri", redirectURI, "role", roleName)
+		}
 
-	if !validRedirect(redirectURI, role.AllowedRedirectURIs) {
-		logger.Warn("unauthorized redirect_uri", "redirect_uri", redirectURI)
+		if role == nil {
+			role = r
+		} else if !sameAuthRequest(role, r) {
+			logger.Warn("skipping role with different OIDC request settings", "role", roleName, "first_role", candidates[0])
+			continue
+		}
+		candidates = append(candidates, roleName)
+	}
+	if role == nil {
 		return resp, nil
 	}
 
@@ -247,25 +946,76 @@ func (b *jwtAuthBackend) authURL(ctx context.Context, req *logical.Request, d *f
 		return resp, nil
 	}
 
-	// "openid" is a required scope for OpenID Connect flows
-	scopes := append([]string{oidc.ScopeOpenID}, role.OIDCScopes...)
-
 	// Configure an OpenID Connect aware OAuth2 client
 	oauth2Config := oauth2.Config{
 		ClientID:     config.OIDCClientID,
 		ClientSecret: config.OIDCClientSecret,
 		RedirectURL:  redirectURI,
 		Endpoint:     provider.Endpoint(),
-		Scopes:       scopes,
+		Scopes:       authScopes(role),
 	}
 
-	stateID, nonce, err := b.createState(roleName, redirectURI)
-	if err != nil {
-		logger.Warn("error generating OAuth state", "error", err)
-		return resp, nil
+	// A preview shows the parameters of the auth URL without starting a login,
+	// so nothing is generated or stored.
+	preview := d.Get("preview").(bool)
+
+	stateID, nonce, codeChallenge := previewState, previewNonce, previewCodeChallenge
+	if !preview {
+		var codeVerifier string
+		if config.OIDCEnablePKCE {
+			codeVerifier, err = createCodeVerifier()
+			if err != nil {
+				logger.Warn("error generating PKCE code verifier", "error", err)
+				return resp, nil
+			}
+			codeChallenge = codeChallengeS256(codeVerifier)
+		}
+
+		stateID, nonce, err = b.createState(config, candidates, roleFromClaim, redirectURI, codeVerifier)
+		if err != nil {
+			logger.Warn("error generating OAuth state", "error", err)
+			return resp, nil
+		}
 	}
 
-	resp.Data["auth_url"] = oauth2Config.AuthCodeURL(stateID, oidc.Nonce(nonce))
+	var authCodeOpts []oauth2.AuthCodeOption
+	if !role.OIDCSkipNonce {
+		authCodeOpts = append(authCodeOpts, oidc.Nonce(nonce))
+	}
+	if role.OIDCResponseMode != "" {
+		authCodeOpts = append(authCodeOpts, oauth2.SetAuthURLParam("response_mode", role.OIDCResponseMode))
+	}
+	if role.OIDCPrompt != "" {
+		authCodeOpts = append(authCodeOpts, oauth2.SetAuthURLParam("prompt", role.OIDCPrompt))
+	}
+	if len(role.OIDCACRValues) > 0 {
+		authCodeOpts = append(authCodeOpts, oauth2.SetAuthURLParam("acr_values", strings.Join(role.OIDCACRValues, " ")))
+	}
+	if role.OIDCMaxAge > 0 {
+		authCodeOpts = append(authCodeOpts, oauth2.SetAuthURLParam("max_age", strconv.FormatInt(int64(role.OIDCMaxAge.Seconds()), 10)))
+	}
+	if config.OIDCEnablePKCE {
+		authCodeOpts = append(authCodeOpts,
+			oauth2.SetAuthURLParam("code_challenge", codeChallenge),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+	}
+
+	authURL := oauth2Config.AuthCodeURL(stateID, authCodeOpts...)
+	resp.Data["auth_url"] = authURL
+
+	if preview {
+		parsedURL, err := url.Parse(authURL)
+		if err != nil {
+			return nil, err
+		}
+		var params []string
+		for param := range parsedURL.Query() {
+			params = append(params, param)
+		}
+		sort.Strings(params)
+		resp.Data["auth_url_params"] = params
+	}
 
 	return resp, nil
 }
@@ -273,25 +1023,50 @@ func (b *jwtAuthBackend) authURL(ctx context.Context, req *logical.Request, d *f
 // createState make an expiring state object, associated with a random state ID
 // that is passed throughout the OAuth process. A nonce is also included in the
 // auth process, and for simplicity will be identical in length/format as the state ID.
-func (b *jwtAuthBackend) createState(rolename, redirectURI string) (string, string, error) {
-	// Get enough bytes for 2 160-bit IDs (per rfc6749#section-10.10)
-	bytes, err := uuid.GenerateRandomBytes(2 * 20)
+// The PKCE code verifier, if any, is kept with the state for use during code exchange.
+// States expire after the configured oidc_state_ttl.
+func (b *jwtAuthBackend) createState(config *jwtConfig, roleNames []string, roleFromClaim bool, redirectURI, codeVerifier string) (string, string, error) {
+	// Get enough bytes for the state and nonce, which are 160-bit IDs by
+	// default (per rfc6749#section-10.10)
+	stateLength := config.stateLength()
+	bytes, err := uuid.GenerateRandomBytes(stateLength + config.nonceLength())
 	if err != nil {
 		return "", "", err
 	}
 
-	stateID := fmt.Sprintf("%x", bytes[:20])
-	nonce := fmt.Sprintf("%x", bytes[20:])
+	stateID := fmt.Sprintf("%x", bytes[:stateLength])
+	nonce := fmt.Sprintf("%x", bytes[stateLength:])
 
-	b.oidcStates.SetDefault(stateID, &oidcState{
-		rolename:    rolename,
-		nonce:       nonce,
-		redirectURI: redirectURI,
-	})
+	b.oidcStates.Set(stateID, &oidcState{
+		roleNames:     roleNames,
+		nonce:         nonce,
+		redirectURI:   redirectURI,
+		codeVerifier:  codeVerifier,
+		roleFromClaim: roleFromClaim,
+		createdAt:     time.Now(),
+	}, config.stateTTL())
 
 	return stateID, nonce, nil
 }
 
+// createCodeVerifier returns a random PKCE code verifier. 32 random bytes encode
+// to the 43 character minimum length required by rfc7636#section-4.1.
+func createCodeVerifier() (string, error) {
+	bytes, err := uuid.GenerateRandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// codeChallengeS256 derives the PKCE code challenge for a verifier using the
+// S256 method (rfc7636#section-4.2).
+func codeChallengeS256(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
 // verifyState tests whether the provided state ID is valid and returns the
 // associated state object if so. A nil state is returned if the ID is not found
 // or expired. The state should only ever be retrieved once and is deleted as
@@ -306,7 +1081,138 @@ func (b *jwtAuthBackend) verifyState(stateID string) *oidcState {
 	return nil
 }
 
+// exchangeCode exchanges the authorization code for tokens at the provider's
+// token endpoint.
+func (b *jwtAuthBackend) exchangeCode(oidcCtx context.Context, config *jwtConfig, provider *oidc.Provider, state *oidcState, code string) (*oauth2.Token, error) {
+	oauth2Config := oauth2.Config{
+		ClientID:     config.OIDCClientID,
+		ClientSecret: config.OIDCClientSecret,
+		RedirectURL:  state.redirectURI,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID},
+	}
+
+	exchangeOpts, err := clientAuthOptions(config, &oauth2Config)
+	if err != nil {
+		return nil, errwrap.Wrapf("error preparing client authentication: {{err}}", err)
+	}
+	if state.codeVerifier != "" {
+		exchangeOpts = append(exchangeOpts, oauth2.SetAuthURLParam("code_verifier", state.codeVerifier))
+	}
+
+	return oauth2Config.Exchange(oidcCtx, code, exchangeOpts...)
+}
+
+// staleEndpointError reports whether err, returned by a request to one of the
+// provider's endpoints, suggests that the endpoint has moved: the endpoint was
+// not found, or its host could not be resolved or connected to. Other network
+// errors, such as timeouts, may occur after the provider has received the
+// request and redeemed the code, so they are not treated as stale.
+func staleEndpointError(err error) bool {
+	switch e := err.(type) {
+	case *oauth2.RetrieveError:
+		return e.Response != nil && e.Response.StatusCode == http.StatusNotFound
+	case *url.Error:
+		switch netErr := e.Err.(type) {
+		case *net.DNSError:
+			return !netErr.Timeout()
+		case *net.OpError:
+			// Failures to resolve or connect to the host, including refused
+			// connections, are reported by the dial operation.
+			return netErr.Op == "dial" && !netErr.Timeout()
+		}
+	}
+	return false
+}
+
+// clientAuthOptions sets up oauth2Config to authenticate the client to the
+// token endpoint using the configured method, returning any extra parameters
+// to send with the code exchange.
+func clientAuthOptions(config *jwtConfig, oauth2Config *oauth2.Config) ([]oauth2.AuthCodeOption, error) {
+	switch config.OIDCClientAuthMethod {
+	case "", clientAuthMethodBasic:
+		// The style is always set, as oauth2 would otherwise probe for it by
+		// re-sending a failed token request, and with it the code.
+		oauth2Config.Endpoint.AuthStyle = oauth2.AuthStyleInHeader
+	case clientAuthMethodPost:
+		oauth2Config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	case clientAuthMethodNone:
+		oauth2Config.ClientSecret = ""
+		oauth2Config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	case clientAuthMethodPrivateKeyJWT:
+		oauth2Config.ClientSecret = ""
+		oauth2Config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+
+		assertion, err := clientAssertion(config, oauth2Config.Endpoint.TokenURL)
+		if err != nil {
+			return nil, err
+		}
+		return []oauth2.AuthCodeOption{
+			oauth2.SetAuthURLParam("client_assertion_type", clientAssertionType),
+			oauth2.SetAuthURLParam("client_assertion", assertion),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// clientAssertion returns a short-lived JWT, signed with the configured client
+// signing key, that authenticates the client to the token endpoint.
+func clientAssertion(config *jwtConfig, tokenURL string) (string, error) {
+	key, err := parseClientSigningKey(config.OIDCClientSigningKey)
+	if err != nil {
+		return "", err
+	}
+
+	signer, err := jose.NewSigner(key, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:   config.OIDCClientID,
+		Subject:  config.OIDCClientID,
+		Audience: jwt.Audience{tokenURL},
+		ID:       id,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionTTL)),
+	}
+
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// authScopes returns the scopes requested for logins with the role.
+func authScopes(role *jwtRole) []string {
+	// "openid" is a required scope for OpenID Connect flows
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range role.OIDCScopes {
+		if !strutil.StrListContains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// sameAuthRequest reports whether an auth URL built for role a requests the
+// same scopes, nonce and authentication parameters as one built for role b,
+// so that a login started with it may complete with either role.
+func sameAuthRequest(a, b *jwtRole) bool {
+	return strutil.EquivalentSlices(authScopes(a), authScopes(b)) &&
+		a.OIDCSkipNonce == b.OIDCSkipNonce &&
+		a.OIDCResponseMode == b.OIDCResponseMode &&
+		a.OIDCPrompt == b.OIDCPrompt &&
+		a.OIDCMaxAge == b.OIDCMaxAge &&
+		strings.Join(a.OIDCACRValues, " ") == strings.Join(b.OIDCACRValues, " ")
+}
+
 // validRedirect checks whether uri is in allowed using special handling for loopback uris.
+// Allowed uris whose host starts with a "*." label match any single subdomain label.
 // Ref: https://tools.ietf.org/html/rfc8252#section-7.3
 func validRedirect(uri string, allowed []string) bool {
 	inputURI, err := url.Parse(uri)
@@ -314,9 +1220,18 @@ func validRedirect(uri string, allowed []string) bool {
 		return false
 	}
 
-	// if uri isn't a loopback, just string search the allowed list
+	// if uri isn't a loopback, string search the allowed list and then try
+	// any wildcard entries
 	if !strutil.StrListContains([]string{"localhost", "127.0.0.1", "::1"}, inputURI.Hostname()) {
-		return strutil.StrListContains(allowed, uri)
+		if strutil.StrListContains(allowed, uri) {
+			return true
+		}
+		for _, a := range allowed {
+			if matchWildcardRedirect(inputURI, a) {
+				return true
+			}
+		}
+		return false
 	}
 
 	// otherwise, search for a match in a port-agnostic manner, per the OAuth RFC.
@@ -336,3 +1251,53 @@ func validRedirect(uri string, allowed []string) bool {
 
 	return false
 }
+
+// validAnyRedirect checks whether uri may be used with allow_all_redirect_uris:
+// it must be an https URI, or an http URI on a loopback address.
+func validAnyRedirect(uri string) bool {
+	inputURI, err := url.Parse(uri)
+	if err != nil || inputURI.Host == "" {
+		return false
+	}
+
+	switch inputURI.Scheme {
+	case "https":
+		return true
+	case "http":
+		return strutil.StrListContains([]string{"localhost", "127.0.0.1", "::1"}, inputURI.Hostname())
+	}
+
+	return false
+}
+
+// matchWildcardRedirect checks whether inputURI matches an allowed uri with a
+// wildcard host. The wildcard matches exactly one label; everything else,
+// including the scheme, port and path, must match exactly.
+func matchWildcardRedirect(inputURI *url.URL, allowed string) bool {
+	allowedURI, err := url.Parse(allowed)
+	if err != nil || !validWildcardHost(allowedURI.Hostname()) {
+		return false
+	}
+
+	suffix := strings.TrimPrefix(allowedURI.Hostname(), "*")
+	label := strings.TrimSuffix(inputURI.Hostname(), suffix)
+	if label == inputURI.Hostname() || label == "" || strings.Contains(label, ".") {
+		return false
+	}
+
+	// with the label substituted for the wildcard, the uris must be identical
+	expected := *allowedURI
+	expected.Host = strings.Replace(allowedURI.Host, "*", label, 1)
+	return expected.String() == inputURI.String()
+}
+
+// validWildcardHost reports whether host is an acceptable wildcard pattern: a
+// leading "*." label followed by at least two fixed labels, so that patterns
+// such as "*" or "*.com" are never honored.
+func validWildcardHost(host string) bool {
+	if !strings.HasPrefix(host, "*.") {
+		return false
+	}
+	rest := host[2:]
+	return !strings.Contains(rest, "*") && strings.Count(rest, ".") >= 1 && !strings.HasPrefix(rest, ".") && !strings.HasSuffix(rest, ".")
+}
@@ -1,21 +1,31 @@
 package jwtauth
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/go-test/deep"
+	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/logical"
+	"golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
@@ -208,29 +218,49 @@ func TestOIDC_AuthURL(t *testing.T) {
 	})
 }
 
-func TestOIDC_Callback(t *testing.T) {
-	getBackendAndServer := func(t *testing.T) (logical.Backend, logical.Storage, *oidcProvider) {
-		b, storage := getBackend(t)
-		s := newOIDCProvider(t)
-		s.clientID = "abc"
-		s.clientSecret = "def"
+func TestOIDC_AuthURL_Scopes(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
 
-		// Configure backend
-		data := map[string]interface{}{
+	// Configure backend
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
 			"oidc_discovery_url": s.server.URL,
 			"oidc_client_id":     "abc",
 			"oidc_client_secret": "def",
-			"default_role":       "test",
-			"bound_issuer":       "http://vault.example.com/",
-			"jwt_supported_algs": []string{"ES256"},
-		}
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	tests := []struct {
+		scopes   []string
+		expected string
+	}{
+		{nil, "openid"},
+		{[]string{"email", "profile"}, "openid email profile"},
+		{[]string{"profile", "openid", "groups"}, "openid profile groups"},
+	}
+
+	for i, test := range tests {
+		roleName := fmt.Sprintf("test%d", i)
 
-		// basic configuration
 		req := &logical.Request{
-			Operation: logical.UpdateOperation,
-			Path:      configPath,
+			Operation: logical.CreateOperation,
+			Path:      "role/" + roleName,
 			Storage:   storage,
-			Data:      data,
+			Data: map[string]interface{}{
+				"user_claim":            "email",
+				"allowed_redirect_uris": []string{"https://example.com"},
+				"oidc_scopes":           test.scopes,
+			},
 		}
 
 		resp, err := b.HandleRequest(context.Background(), req)
@@ -238,31 +268,14 @@ func TestOIDC_Callback(t *testing.T) {
 			t.Fatalf("err:%v resp:%#v\n", err, resp)
 		}
 
-		// set up test role
-		data = map[string]interface{}{
-			"role_type":             "oidc",
-			"user_claim":            "email",
-			"allowed_redirect_uris": []string{"https://example.com"},
-			"claim_mappings": map[string]string{
-				"COLOR":        "color",
-				"/nested/Size": "size",
-			},
-			"groups_claim": "/nested/Groups",
-			"ttl":          "3m",
-			"max_ttl":      "5m",
-			"bound_claims": map[string]interface{}{
-				"password":            "foo",
-				"sk":                  "42",
-				"/nested/secret_code": "bar",
-				"temperature":         "76",
-			},
-		}
-
 		req = &logical.Request{
-			Operation: logical.CreateOperation,
-			Path:      "role/test",
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
 			Storage:   storage,
-			Data:      data,
+			Data: map[string]interface{}{
+				"role":         roleName,
+				"redirect_uri": "https://example.com",
+			},
 		}
 
 		resp, err = b.HandleRequest(context.Background(), req)
@@ -270,116 +283,3922 @@ func TestOIDC_Callback(t *testing.T) {
 			t.Fatalf("err:%v resp:%#v\n", err, resp)
 		}
 
-		return b, storage, s
+		authURL := resp.Data["auth_url"].(string)
+		if scope := getQueryParam(t, authURL, "scope"); scope != test.expected {
+			t.Fatalf("scopes %v: expected scope %q, got %q", test.scopes, test.expected, scope)
+		}
 	}
+}
 
-	t.Run("successful login", func(t *testing.T) {
-		b, storage, s := getBackendAndServer(t)
-		defer s.server.Close()
+func TestOIDC_AuthURL_AllowAllRedirectURIs(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
 
-		// get auth_url
-		data := map[string]interface{}{
-			"role":         "test",
-			"redirect_uri": "https://example.com",
-		}
-		req := &logical.Request{
-			Operation: logical.UpdateOperation,
-			Path:      "oidc/auth_url",
-			Storage:   storage,
-			Data:      data,
-		}
+	// Configure backend
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_client_id":     "abc",
+			"oidc_client_secret": "def",
+		},
+	}
 
-		resp, err := b.HandleRequest(context.Background(), req)
-		if err != nil || (resp != nil && resp.IsError()) {
-			t.Fatalf("err:%v resp:%#v\n", err, resp)
-		}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
 
-		authURL := resp.Data["auth_url"].(string)
+	// A role without the flag still requires allowed_redirect_uris
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/strict",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim": "email",
+		},
+	}
 
-		state := getQueryParam(t, authURL, "state")
-		nonce := getQueryParam(t, authURL, "nonce")
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsError() {
+		t.Fatalf("expected error without allowed_redirect_uris, got: %#v", resp)
+	}
 
-		// set provider claims that will be returned by the mock server
-		s.customClaims = map[string]interface{}{
-			"nonce": nonce,
-			"email": "bob@example.com",
-			"COLOR": "green",
-			"sk":    "42",
-			"nested": map[string]interface{}{
-				"Size":        "medium",
-				"Groups":      []string{"a", "b"},
-				"secret_code": "bar",
-			},
-			"password": "foo",
-		}
+	req.Data["allowed_redirect_uris"] = []string{"https://example.com"}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
 
-		// set mock provider's expected code
-		s.code = "abc"
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/dev",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim":              "email",
+			"allow_all_redirect_uris": true,
+		},
+	}
 
-		// invoke the callback, which will in to try to exchange the code
-		// with the mock provider.
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+	if resp == nil || len(resp.Warnings) == 0 {
+		t.Fatalf("expected a warning, got: %#v", resp)
+	}
+
+	tests := []struct {
+		role        string
+		redirectURI string
+		allowed     bool
+	}{
+		{"strict", "https://example.com", true},
+		{"strict", "https://pr-123.dev.example.com/callback", false},
+		{"dev", "https://pr-123.dev.example.com/callback", true},
+		{"dev", "http://localhost:8250/oidc/callback", true},
+		{"dev", "http://dev.example.com/callback", false},
+	}
+
+	for _, test := range tests {
 		req = &logical.Request{
-			Operation: logical.ReadOperation,
-			Path:      "oidc/callback",
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
 			Storage:   storage,
 			Data: map[string]interface{}{
-				"state": state,
-				"code":  "abc",
+				"role":         test.role,
+				"redirect_uri": test.redirectURI,
 			},
 		}
 
 		resp, err = b.HandleRequest(context.Background(), req)
-		if err != nil {
-			t.Fatal(err)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
 		}
 
-		expected := &logical.Auth{
-			LeaseOptions: logical.LeaseOptions{
-				Renewable: true,
-				TTL:       3 * time.Minute,
-				MaxTTL:    5 * time.Minute,
-			},
-			InternalData: map[string]interface{}{
-				"role": "test",
-			},
-			DisplayName: "bob@example.com",
-			Alias: &logical.Alias{
-				Name: "bob@example.com",
-				Metadata: map[string]string{
-					"color": "green",
-					"size":  "medium",
-				},
-			},
-			GroupAliases: []*logical.Alias{
-				{Name: "a"},
-				{Name: "b"},
-			},
-			Metadata: map[string]string{
-				"role":  "test",
-				"color": "green",
-				"size":  "medium",
-			},
+		if allowed := resp.Data["auth_url"].(string) != ""; allowed != test.allowed {
+			t.Fatalf("role %s, redirect_uri %s: expected allowed: %t, got: %t", test.role, test.redirectURI, test.allowed, allowed)
 		}
-		auth := resp.Auth
-		if diff := deep.Equal(auth, expected); diff != nil {
-			t.Fatal(diff)
+	}
+}
+
+func TestOIDC_AuthURL_Preview(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+
+	// Configure backend
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_client_id":     "abc",
+			"oidc_client_secret": "def",
+			"oidc_enable_pkce":   true,
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim":            "email",
+			"allowed_redirect_uris": []string{"https://example.com"},
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "oidc/auth_url",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role":         "test",
+			"redirect_uri": "https://example.com",
+			"preview":      true,
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	states := b.(*jwtAuthBackend).oidcStates
+	if n := states.ItemCount(); n != 0 {
+		t.Fatalf("expected no stored states, got %d", n)
+	}
+
+	authURL := resp.Data["auth_url"].(string)
+	for param, expected := range map[string]string{
+		"state":          "{state}",
+		"nonce":          "{nonce}",
+		"code_challenge": "{code_challenge}",
+		"redirect_uri":   "https://example.com",
+	} {
+		if actual := getQueryParam(t, authURL, param); actual != expected {
+			t.Fatalf("expected %s %q, got %q", param, expected, actual)
+		}
+	}
+
+	expectedParams := []string{"client_id", "code_challenge", "code_challenge_method", "nonce", "redirect_uri", "response_type", "scope", "state"}
+	if diff := deep.Equal(resp.Data["auth_url_params"], expectedParams); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// A regular request still stores its state
+	delete(req.Data, "preview")
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+	if n := states.ItemCount(); n != 1 {
+		t.Fatalf("expected 1 stored state, got %d", n)
+	}
+	if _, ok := resp.Data["auth_url_params"]; ok {
+		t.Fatal("unexpected auth_url_params outside of preview")
+	}
+}
+
+func TestOIDC_AuthURL_AuthParams(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+
+	// Configure backend
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_client_id":     "abc",
+			"oidc_client_secret": "def",
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim":            "email",
+			"allowed_redirect_uris": []string{"https://example.com"},
+			"oidc_prompt":           "login",
+			"oidc_max_age":          "5m",
+			"oidc_acr_values":       "urn:mace:incommon:iap:silver,phr",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "oidc/auth_url",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role":         "test",
+			"redirect_uri": "https://example.com",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	authURL := resp.Data["auth_url"].(string)
+	if prompt := getQueryParam(t, authURL, "prompt"); prompt != "login" {
+		t.Fatalf("unexpected prompt: %q", prompt)
+	}
+	if maxAge := getQueryParam(t, authURL, "max_age"); maxAge != "300" {
+		t.Fatalf("unexpected max_age: %q", maxAge)
+	}
+	// acr_values sorts first and so can't be found with getQueryParam
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acrValues := u.Query().Get("acr_values"); acrValues != "urn:mace:incommon:iap:silver phr" {
+		t.Fatalf("unexpected acr_values: %q", acrValues)
+	}
+
+	// invalid prompt values are rejected
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_prompt": "always",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !strings.Contains(resp.Error().Error(), "invalid 'oidc_prompt'") {
+		t.Fatalf("expected prompt error response, got: %#v", resp)
+	}
+}
+
+func TestOIDC_AuthURL_RandomLength(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim":            "email",
+			"allowed_redirect_uris": []string{"https://example.com"},
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	tests := []struct {
+		stateLength   int
+		nonceLength   int
+		expectedState int
+		expectedNonce int
+		errExpected   bool
+	}{
+		{0, 0, 40, 40, false},
+		{32, 48, 64, 96, false},
+		{8, 0, 0, 0, true},
+		{0, 15, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_discovery_url": s.server.URL,
+				"oidc_client_id":     "abc",
+				"oidc_client_secret": "def",
+				"default_role":       "test",
+				"oidc_state_length":  test.stateLength,
+				"oidc_nonce_length":  test.nonceLength,
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.errExpected {
+			if resp == nil || !resp.IsError() {
+				t.Fatalf("expected error response for lengths %d/%d, got: %#v", test.stateLength, test.nonceLength, resp)
+			}
+			continue
+		}
+		if resp != nil && resp.IsError() {
+			t.Fatalf("unexpected error response: %v", resp.Error())
+		}
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+		if state := getQueryParam(t, authURL, "state"); len(state) != test.expectedState {
+			t.Fatalf("expected state of length %d, got %q", test.expectedState, state)
+		}
+		if nonce := getQueryParam(t, authURL, "nonce"); len(nonce) != test.expectedNonce {
+			t.Fatalf("expected nonce of length %d, got %q", test.expectedNonce, nonce)
+		}
+	}
+}
+
+func TestOIDC_DiscoveryCAPEM(t *testing.T) {
+	b, storage := getBackend(t)
+	s, caPEM := newTLSOIDCProvider(t)
+	defer s.server.Close()
+	s.clientID = "abc"
+
+	writeConfig := func(caPEM string) *logical.Response {
+		t.Helper()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_discovery_url":    s.server.URL,
+				"oidc_discovery_ca_pem": caPEM,
+				"oidc_client_id":        "abc",
+				"oidc_client_secret":    "def",
+				"default_role":          "test",
+				"jwt_supported_algs":    []string{"ES256"},
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// the mock provider's certificate isn't trusted by the system roots,
+	// nor by unrelated CA certificates
+	for _, badCA := range []string{"", oidcBadCACerts} {
+		if resp := writeConfig(badCA); resp == nil || !resp.IsError() {
+			t.Fatalf("expected error response, got: %#v", resp)
+		}
+	}
+
+	if resp := writeConfig(caPEM); resp != nil && resp.IsError() {
+		t.Fatalf("unexpected error response: %v", resp.Error())
+	}
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim":            "email",
+			"allowed_redirect_uris": []string{"https://example.com"},
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "oidc/auth_url",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"redirect_uri": "https://example.com",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	authURL := resp.Data["auth_url"].(string)
+
+	s.customClaims = map[string]interface{}{
+		"nonce": getQueryParam(t, authURL, "nonce"),
+		"email": "bob@example.com",
+	}
+	s.code = "abc"
+
+	// the code exchange and userinfo requests must use the configured roots
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "oidc/callback",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"state": getQueryParam(t, authURL, "state"),
+			"code":  "abc",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.IsError() {
+		t.Fatalf("unexpected error response: %v", resp.Error())
+	}
+	if resp.Auth.DisplayName != "bob@example.com" {
+		t.Fatalf("unexpected auth: %#v", resp.Auth)
+	}
+}
+
+func TestOIDC_HTTPProxy(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+
+	var proxied []string
+	proxy := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			proxied = append(proxied, r.URL.Path)
+		},
+	})
+	defer proxy.Close()
+
+	for _, invalid := range []string{"ftp://proxy.example.com", "proxy.example.com:3128", "http://"} {
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_discovery_url": s.server.URL,
+				"oidc_http_proxy":    invalid,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil || !strings.Contains(resp.Error().Error(), "oidc_http_proxy") {
+			t.Fatalf("proxy %q: expected proxy error response, got: %#v", invalid, resp)
+		}
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_http_proxy":    proxy.URL,
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	if diff := deep.Equal(proxied, []string{"/.well-known/openid-configuration"}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestOIDC_Discovery(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+
+	// reading before discovery is configured is an error
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "oidc/discovery",
+		Storage:   storage,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected error response, got: %#v", resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "oidc/discovery",
+		Storage:   storage,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	expected := map[string]interface{}{
+		"issuer":                 s.server.URL,
+		"authorization_endpoint": s.server.URL + "/auth",
+		"token_endpoint":         s.server.URL + "/token",
+		"jwks_uri":               s.server.URL + "/certs",
+		"userinfo_endpoint":      s.server.URL + "/userinfo",
+		"end_session_endpoint":   "",
+	}
+	if diff := deep.Equal(resp.Data, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestOIDC_LogoutURL(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+
+	configure := func() {
+		t.Helper()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_discovery_url": s.server.URL,
+				"oidc_client_id":     "abc",
+				"oidc_client_secret": "def",
+				"default_role":       "test",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+	}
+
+	logoutURL := func(data map[string]interface{}) *logical.Response {
+		t.Helper()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/logout_url",
+			Storage:   storage,
+			Data:      data,
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	configure()
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim":            "email",
+			"allowed_redirect_uris": []string{"https://example.com/callback", "https://example.com/logged-out"},
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	// the provider doesn't support logout
+	resp = logoutURL(nil)
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "end_session_endpoint") {
+		t.Fatalf("expected error response, got: %#v", resp)
+	}
+
+	s.endSessionEndpoint = "/logout?tenant=acme"
+	configure()
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "oidc/discovery",
+		Storage:   storage,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+	if resp.Data["end_session_endpoint"] != s.server.URL+"/logout?tenant=acme" {
+		t.Fatalf("unexpected end_session_endpoint: %v", resp.Data["end_session_endpoint"])
+	}
+
+	resp = logoutURL(map[string]interface{}{
+		"id_token_hint":            "some.id.token",
+		"post_logout_redirect_uri": "https://example.com/logged-out",
+	})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("unexpected response: %#v", resp)
+	}
+
+	parsed, err := url.Parse(resp.Data["logout_url"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Scheme+"://"+parsed.Host+parsed.Path != s.server.URL+"/logout" {
+		t.Fatalf("unexpected logout URL: %s", parsed)
+	}
+	expected := url.Values{
+		"tenant":                   {"acme"},
+		"id_token_hint":            {"some.id.token"},
+		"post_logout_redirect_uri": {"https://example.com/logged-out"},
+		"client_id":                {"abc"},
+	}
+	if diff := deep.Equal(parsed.Query(), expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// the redirect URI must be allowed by the role
+	for _, data := range []map[string]interface{}{
+		{"post_logout_redirect_uri": "https://evil.example.com"},
+		{"post_logout_redirect_uri": "https://example.com/logged-out", "role": "missing"},
+	} {
+		resp = logoutURL(data)
+		if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "unauthorized post_logout_redirect_uri") {
+			t.Fatalf("expected error response, got: %#v", resp)
+		}
+	}
+}
+
+func TestOIDC_Test(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "oidc/test",
+		Storage:   storage,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	expected := map[string]interface{}{
+		"issuer":   s.server.URL,
+		"jwks_url": s.server.URL + "/certs",
+		"keys":     1,
+	}
+	if diff := deep.Equal(resp.Data, expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// failures are reported once the provider can no longer be reached
+	s.server.Close()
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "error performing discovery") {
+		t.Fatalf("expected discovery error, got: %#v", resp)
+	}
+}
+
+func TestOIDC_StateDelete(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+
+	// Configure backend
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_client_id":     "abc",
+			"oidc_client_secret": "def",
+			"default_role":       "test",
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim":            "email",
+			"allowed_redirect_uris": []string{"https://example.com"},
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "oidc/auth_url",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"redirect_uri": "https://example.com",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	state := getQueryParam(t, resp.Data["auth_url"].(string), "state")
+
+	// delete the pending state, and then a state that doesn't exist
+	for _, stateID := range []string{state, "nonexistent"} {
+		req = &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "oidc/state/" + stateID,
+			Storage:   storage,
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || resp != nil {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+	}
+
+	// the deleted state can no longer be used to complete a login
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "oidc/callback",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"state": state,
+			"code":  "abc",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !strings.Contains(resp.Error().Error(), "Expired or missing OAuth state") {
+		t.Fatalf("expected state error response, got: %#v", resp)
+	}
+}
+
+func TestOIDC_StatesRead(t *testing.T) {
+	b, storage := getBackend(t)
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+
+	// Configure backend
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_client_id":     "abc",
+			"oidc_client_secret": "def",
+			"default_role":       "test",
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim":            "email",
+			"allowed_redirect_uris": []string{"https://example.com"},
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	var states []string
+	for i := 0; i < 3; i++ {
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+		states = append(states, getQueryParam(t, resp.Data["auth_url"].(string), "state"))
+	}
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "oidc/states",
+		Storage:   storage,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	if resp.Data["count"] != 3 {
+		t.Fatalf("expected 3 pending states, got: %v", resp.Data["count"])
+	}
+
+	expectedBuckets := map[string]int{
+		"under_1m":  3,
+		"1m_to_5m":  0,
+		"5m_to_10m": 0,
+		"over_10m":  0,
+	}
+	if diff := deep.Equal(resp.Data["age_buckets"], expectedBuckets); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// no state or nonce may be disclosed
+	out := fmt.Sprintf("%#v", resp.Data)
+	for _, state := range states {
+		if strings.Contains(out, state) {
+			t.Fatalf("response discloses state %q: %s", state, out)
+		}
+	}
+	for _, item := range b.(*jwtAuthBackend).oidcStates.Items() {
+		if nonce := item.Object.(*oidcState).nonce; strings.Contains(out, nonce) {
+			t.Fatalf("response discloses nonce %q: %s", nonce, out)
+		}
+	}
+}
+
+func TestOIDC_VerboseLogging(t *testing.T) {
+	var logs bytes.Buffer
+	config := &logical.BackendConfig{
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Output: &logs,
+			Level:  hclog.Debug,
+		}),
+		System:      &logical.StaticSystemView{},
+		StorageView: &logical.InmemStorage{},
+	}
+	b, err := Factory(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+	storage := config.StorageView
+
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+	s.clientID = "abc"
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"user_claim":            "email",
+			"allowed_redirect_uris": []string{"https://example.com"},
+			"bound_claims": map[string]interface{}{
+				"department": "engineering",
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	for _, verbose := range []bool{false, true} {
+		logs.Reset()
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_discovery_url":   s.server.URL,
+				"oidc_client_id":       "abc",
+				"oidc_client_secret":   "def",
+				"default_role":         "test",
+				"jwt_supported_algs":   []string{"ES256"},
+				"verbose_oidc_logging": verbose,
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		s.customClaims = map[string]interface{}{
+			"nonce":      getQueryParam(t, authURL, "nonce"),
+			"email":      "bob@example.com",
+			"department": "sales-department",
+		}
+		s.code = "abc"
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": getQueryParam(t, authURL, "state"),
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil || !resp.IsError() {
+			t.Fatalf("expected error response, got: %#v", resp)
+		}
+
+		// claims must only be logged when verbose logging is enabled, and
+		// never included in the response
+		if logged := strings.Contains(logs.String(), "sales-department"); logged != verbose {
+			t.Fatalf("verbose: %t, claims logged: %t, logs: %s", verbose, logged, logs.String())
+		}
+		if strings.Contains(resp.Error().Error(), "sales-department") {
+			t.Fatalf("claims included in response: %v", resp.Error())
+		}
+	}
+}
+
+func TestOIDC_DefaultRoles(t *testing.T) {
+	b, storage := getBackend(t)
+
+	s := newOIDCProvider(t)
+	defer s.server.Close()
+	s.clientID = "abc"
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_client_id":     "abc",
+			"oidc_client_secret": "def",
+			"default_roles":      []string{"engineering", "sales"},
+			"jwt_supported_algs": []string{"ES256"},
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	for _, roleName := range []string{"engineering", "sales"} {
+		req = &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "role/" + roleName,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"user_claim":            "email",
+				"allowed_redirect_uris": []string{"https://example.com"},
+				"policies":              roleName,
+				"bound_claims": map[string]interface{}{
+					"department": roleName,
+				},
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+	}
+
+	tests := []struct {
+		department string
+		role       string
+	}{
+		{"engineering", "engineering"},
+		{"sales", "sales"},
+		{"marketing", ""},
+	}
+
+	for _, test := range tests {
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+		if authURL == "" {
+			t.Fatal("expected auth_url")
+		}
+
+		s.customClaims = map[string]interface{}{
+			"nonce":      getQueryParam(t, authURL, "nonce"),
+			"email":      "bob@example.com",
+			"department": test.department,
+		}
+		s.code = "abc"
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": getQueryParam(t, authURL, "state"),
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.role == "" {
+			if resp == nil || !resp.IsError() {
+				t.Fatalf("department %q: expected error, got: %#v", test.department, resp)
+			}
+			// every role's failure is reported, in order
+			msg := resp.Error().Error()
+			engineering, sales := strings.Index(msg, "engineering:"), strings.Index(msg, "sales:")
+			if !strings.Contains(msg, "No default role matched") || engineering < 0 || sales < engineering {
+				t.Fatalf("department %q: unexpected error: %v", test.department, msg)
+			}
+			continue
+		}
+
+		if resp == nil || resp.IsError() {
+			t.Fatalf("department %q: unexpected response: %#v", test.department, resp)
+		}
+		if resp.Auth.InternalData["role"] != test.role || deep.Equal(resp.Auth.Policies, []string{test.role}) != nil {
+			t.Fatalf("department %q: expected role %q, got: %#v", test.department, test.role, resp.Auth)
+		}
+		// the roles have no groups_claim, so no group metadata is recorded
+		if _, ok := resp.Auth.Metadata["groups_source"]; ok {
+			t.Fatalf("department %q: unexpected groups metadata: %v", test.department, resp.Auth.Metadata)
+		}
+	}
+
+	// a role that would request different parameters than the auth URL was
+	// built with is not tried
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "role/sales",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_scopes":     []string{"groups"},
+			"oidc_skip_nonce": true,
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "oidc/auth_url",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"redirect_uri": "https://example.com",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+
+	authURL := resp.Data["auth_url"].(string)
+	if scope := getQueryParam(t, authURL, "scope"); scope != "openid" {
+		t.Fatalf("expected the engineering role's scopes, got: %q", scope)
+	}
+
+	s.customClaims = map[string]interface{}{
+		"nonce":      getQueryParam(t, authURL, "nonce"),
+		"email":      "bob@example.com",
+		"department": "sales",
+	}
+	s.code = "abc"
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "oidc/callback",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"state": getQueryParam(t, authURL, "state"),
+			"code":  "abc",
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the engineering role is tried, so its bound claims fail the login
+	assertErrorCode(t, resp, errCodeBoundClaimFailed)
+
+	// default_role and default_roles are mutually exclusive
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"default_role":       "engineering",
+			"default_roles":      []string{"sales"},
+		},
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "only one of 'default_role' and 'default_roles'") {
+		t.Fatalf("expected error, got: %#v", resp)
+	}
+}
+
+func TestOIDC_StaleEndpointError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	dialTimeout := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}
+	readTimeout := &net.OpError{Op: "read", Net: "tcp", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}
+	noSuchHost := &net.DNSError{Err: "no such host", Name: "idp.invalid"}
+
+	tests := []struct {
+		name  string
+		err   error
+		stale bool
+	}{
+		{"not found", &oauth2.RetrieveError{Response: &http.Response{StatusCode: 404}}, true},
+		{"server error", &oauth2.RetrieveError{Response: &http.Response{StatusCode: 500}}, false},
+		{"connection refused", &url.Error{Op: "Post", URL: "https://idp", Err: refused}, true},
+		{"no such host", &url.Error{Op: "Post", URL: "https://idp", Err: noSuchHost}, true},
+		{"dial timeout", &url.Error{Op: "Post", URL: "https://idp", Err: dialTimeout}, false},
+		{"read timeout", &url.Error{Op: "Post", URL: "https://idp", Err: readTimeout}, false},
+		{"other", errors.New("other"), false},
+	}
+	for _, test := range tests {
+		if stale := staleEndpointError(test.err); stale != test.stale {
+			t.Errorf("%s: expected stale %t, got %t", test.name, test.stale, stale)
+		}
+
+		// key fetch failures are classified the same way from their messages
+		msg := "failed to verify signature: fetching keys oidc: get keys failed " + test.err.Error()
+		if rErr, ok := test.err.(*oauth2.RetrieveError); ok {
+			msg = fmt.Sprintf("failed to verify signature: fetching keys oidc: get keys failed: %d %s", rErr.Response.StatusCode, http.StatusText(rErr.Response.StatusCode))
+		}
+		if fetchFailed := keyFetchFailed(errors.New(msg)); fetchFailed != test.stale {
+			t.Errorf("%s: expected key fetch failure %t, got %t for %q", test.name, test.stale, fetchFailed, msg)
+		}
+	}
+}
+
+func TestOIDC_ValidateAuthTime(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		authTime    interface{}
+		leeway      time.Duration
+		errExpected bool
+	}{
+		{"recent", float64(now.Add(-1 * time.Minute).Unix()), 0, false},
+		{"recent json.Number", json.Number(fmt.Sprint(now.Add(-1 * time.Minute).Unix())), 0, false},
+		{"stale", float64(now.Add(-10 * time.Minute).Unix()), 0, true},
+		{"stale within leeway", float64(now.Add(-5*time.Minute - 30*time.Second).Unix()), time.Minute, false},
+		{"stale beyond leeway", float64(now.Add(-7 * time.Minute).Unix()), time.Minute, true},
+		{"missing", nil, 0, true},
+		{"invalid", "yesterday", 0, true},
+	}
+
+	for _, test := range tests {
+		claims := map[string]interface{}{}
+		if test.authTime != nil {
+			claims["auth_time"] = test.authTime
+		}
+
+		err := validateAuthTime(claims, 5*time.Minute, test.leeway, now)
+		if (err != nil) != test.errExpected {
+			t.Fatalf("case %q: expected error: %t, actual: %v", test.name, test.errExpected, err)
+		}
+	}
+}
+
+func TestOIDC_Callback(t *testing.T) {
+	getBackendAndServer := func(t *testing.T) (logical.Backend, logical.Storage, *oidcProvider) {
+		b, storage := getBackend(t)
+		s := newOIDCProvider(t)
+		s.clientID = "abc"
+		s.clientSecret = "def"
+
+		// Configure backend
+		data := map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_client_id":     "abc",
+			"oidc_client_secret": "def",
+			"default_role":       "test",
+			"bound_issuer":       "http://vault.example.com/",
+			"jwt_supported_algs": []string{"ES256"},
+		}
+
+		// basic configuration
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data:      data,
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		// set up test role
+		data = map[string]interface{}{
+			"role_type":             "oidc",
+			"user_claim":            "email",
+			"allowed_redirect_uris": []string{"https://example.com"},
+			"claim_mappings": map[string]string{
+				"COLOR":        "color",
+				"/nested/Size": "size",
+			},
+			"groups_claim": "/nested/Groups",
+			"ttl":          "3m",
+			"max_ttl":      "5m",
+			"bound_claims": map[string]interface{}{
+				"password":            "foo",
+				"sk":                  "42",
+				"/nested/secret_code": "bar",
+				"temperature":         "76",
+			},
+		}
+
+		req = &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data:      data,
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		return b, storage, s
+	}
+
+	t.Run("successful login", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// get auth_url
+		data := map[string]interface{}{
+			"role":         "test",
+			"redirect_uri": "https://example.com",
+		}
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data:      data,
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		state := getQueryParam(t, authURL, "state")
+		nonce := getQueryParam(t, authURL, "nonce")
+
+		// set provider claims that will be returned by the mock server
+		s.customClaims = map[string]interface{}{
+			"nonce": nonce,
+			"email": "bob@example.com",
+			"COLOR": "green",
+			"sk":    "42",
+			"nested": map[string]interface{}{
+				"Size":        "medium",
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+
+		// set mock provider's expected code
+		s.code = "abc"
+
+		// invoke the callback, which will in to try to exchange the code
+		// with the mock provider.
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": state,
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := &logical.Auth{
+			LeaseOptions: logical.LeaseOptions{
+				Renewable: true,
+				TTL:       3 * time.Minute,
+				MaxTTL:    5 * time.Minute,
+			},
+			InternalData: map[string]interface{}{
+				"role": "test",
+			},
+			DisplayName: "bob@example.com",
+			Alias: &logical.Alias{
+				Name: "bob@example.com",
+				Metadata: map[string]string{
+					"color": "green",
+					"size":  "medium",
+				},
+			},
+			GroupAliases: []*logical.Alias{
+				{Name: "a"},
+				{Name: "b"},
+			},
+			Metadata: map[string]string{
+				"role":          "test",
+				"color":         "green",
+				"size":          "medium",
+				"groups_source": "claim",
+				"groups_count":  "2",
+			},
+		}
+		auth := resp.Auth
+		if diff := deep.Equal(auth, expected); diff != nil {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("successful login with PKCE", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// enable PKCE on the existing configuration
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_discovery_url": s.server.URL,
+				"oidc_client_id":     "abc",
+				"oidc_client_secret": "def",
+				"default_role":       "test",
+				"bound_issuer":       "http://vault.example.com/",
+				"jwt_supported_algs": []string{"ES256"},
+				"oidc_enable_pkce":   true,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		// get auth_url
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		if method := getQueryParam(t, authURL, "code_challenge_method"); method != "S256" {
+			t.Fatalf("unexpected code_challenge_method: %q", method)
+		}
+
+		state := getQueryParam(t, authURL, "state")
+		nonce := getQueryParam(t, authURL, "nonce")
+
+		// the mock provider will require a verifier matching this challenge
+		s.codeChallenge = getQueryParam(t, authURL, "code_challenge")
+
+		s.customClaims = map[string]interface{}{
+			"nonce": nonce,
+			"email": "bob@example.com",
+			"COLOR": "green",
+			"sk":    "42",
+			"nested": map[string]interface{}{
+				"Size":        "medium",
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+		s.code = "abc"
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": state,
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsError() {
+			t.Fatalf("unexpected error response: %v", resp.Error())
+		}
+		if resp.Auth.Alias.Name != "bob@example.com" {
+			t.Fatalf("unexpected alias name: %q", resp.Auth.Alias.Name)
+		}
+	})
+
+	t.Run("no PKCE parameters by default", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+		if strings.Contains(authURL, "code_challenge") {
+			t.Fatalf("unexpected PKCE parameters in auth_url: %s", authURL)
+		}
+	})
+
+	t.Run("successful login - form_post response mode", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_response_mode": "form_post",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		// get auth_url
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		if mode := getQueryParam(t, authURL, "response_mode"); mode != "form_post" {
+			t.Fatalf("unexpected response_mode: %q", mode)
+		}
+
+		state := getQueryParam(t, authURL, "state")
+		nonce := getQueryParam(t, authURL, "nonce")
+
+		s.customClaims = map[string]interface{}{
+			"nonce": nonce,
+			"email": "bob@example.com",
+			"COLOR": "green",
+			"sk":    "42",
+			"nested": map[string]interface{}{
+				"Size":        "medium",
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+		s.code = "abc"
+
+		// the provider posts the authorization response, including an
+		// id_token which is not used
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state":    state,
+				"code":     "abc",
+				"id_token": "ignored",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsError() {
+			t.Fatalf("unexpected error response: %v", resp.Error())
+		}
+		if resp.Auth.Alias.Name != "bob@example.com" {
+			t.Fatalf("unexpected alias name: %q", resp.Auth.Alias.Name)
+		}
+	})
+
+	t.Run("successful login - token claims take precedence over userinfo", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// get auth_url
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+		state := getQueryParam(t, authURL, "state")
+		nonce := getQueryParam(t, authURL, "nonce")
+
+		// the role has a bound claim of "temperature"=="76"
+		s.customClaims = map[string]interface{}{
+			"nonce":       nonce,
+			"email":       "bob@example.com",
+			"COLOR":       "green",
+			"sk":          "42",
+			"temperature": "76",
+			"nested": map[string]interface{}{
+				"Size":        "medium",
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+		s.userinfo = map[string]interface{}{
+			"sub":         "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
+			"email":       "mallory@example.com",
+			"temperature": "99",
+		}
+		s.code = "abc"
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": state,
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsError() {
+			t.Fatalf("unexpected error response: %v", resp.Error())
+		}
+		if resp.Auth.Alias.Name != "bob@example.com" {
+			t.Fatalf("unexpected alias name: %q", resp.Auth.Alias.Name)
+		}
+	})
+
+	t.Run("failed login - userinfo sub mismatch", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		s.customClaims = map[string]interface{}{
+			"nonce":       getQueryParam(t, authURL, "nonce"),
+			"email":       "bob@example.com",
+			"sk":          "42",
+			"temperature": "76",
+			"nested": map[string]interface{}{
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+		s.userinfo = map[string]interface{}{
+			"sub":   "mallory",
+			"email": "mallory@example.com",
+		}
+		s.code = "abc"
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": getQueryParam(t, authURL, "state"),
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertErrorCode(t, resp, errCodeUserInfoMismatch)
+	})
+
+	t.Run("userinfo claims allowlist", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// the role has a bound claim of "temperature"=="76", which is only
+		// provided by the userinfo endpoint
+		for _, test := range []struct {
+			userinfoClaims []string
+			errExpected    bool
+		}{
+			{[]string{"temperature"}, false},
+			{[]string{"color"}, true},
+		} {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/test",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"userinfo_claims": test.userinfoClaims,
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.IsError() != test.errExpected {
+				t.Fatalf("userinfo_claims %v: expected error: %t, got: %#v", test.userinfoClaims, test.errExpected, resp)
+			}
+			if test.errExpected {
+				assertErrorCode(t, resp, errCodeBoundClaimFailed)
+			}
+		}
+	})
+
+	t.Run("failed login - required userinfo unavailable", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_fetch_userinfo": true,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		// get auth_url
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+		state := getQueryParam(t, authURL, "state")
+		nonce := getQueryParam(t, authURL, "nonce")
+
+		s.customClaims = map[string]interface{}{
+			"nonce":       nonce,
+			"email":       "bob@example.com",
+			"sk":          "42",
+			"temperature": "76",
+			"nested": map[string]interface{}{
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+		s.userinfoError = true
+		s.code = "abc"
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": state,
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil || !strings.Contains(resp.Error().Error(), "Error fetching userinfo") {
+			t.Fatalf("expected userinfo error response, got: %#v", resp)
+		}
+		assertErrorCode(t, resp, "userinfo_failed")
+	})
+
+	t.Run("userinfo disabled", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_discovery_url":    s.server.URL,
+				"oidc_client_id":        "abc",
+				"oidc_client_secret":    "def",
+				"default_role":          "test",
+				"jwt_supported_algs":    []string{"ES256"},
+				"oidc_disable_userinfo": true,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		// the userinfo endpoint would fail the login if it were called
+		s.userinfoError = true
+
+		for _, fetchUserInfo := range []bool{false, true} {
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/test",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"oidc_fetch_userinfo": fetchUserInfo,
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			// temperature is usually provided by the userinfo endpoint
+			s.customClaims = map[string]interface{}{
+				"nonce":       getQueryParam(t, authURL, "nonce"),
+				"email":       "bob@example.com",
+				"sk":          "42",
+				"temperature": "76",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fetchUserInfo {
+				if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "userinfo endpoint is disabled") {
+					t.Fatalf("expected userinfo error response, got: %#v", resp)
+				}
+				assertErrorCode(t, resp, "userinfo_failed")
+			} else if resp.IsError() {
+				t.Fatalf("unexpected error response: %v", resp.Error())
+			}
+		}
+
+		if n := atomic.LoadInt32(&s.userinfoRequests); n != 0 {
+			t.Fatalf("expected no userinfo requests, got %d", n)
+		}
+	})
+
+	t.Run("failed login - token without exp", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		s.customClaims = map[string]interface{}{
+			"nonce": getQueryParam(t, authURL, "nonce"),
+			"email": "bob@example.com",
+			"sk":    "42",
+			"nested": map[string]interface{}{
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+		s.noExpiry = true
+		s.code = "abc"
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": getQueryParam(t, authURL, "state"),
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "missing the exp claim") {
+			t.Fatalf("expected error response, got: %#v", resp)
+		}
+		assertErrorCode(t, resp, "token_invalid")
+	})
+
+	t.Run("failed login - bad nonce", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// get auth_url
+		data := map[string]interface{}{
+			"role":         "test",
+			"redirect_uri": "https://example.com",
+		}
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data:      data,
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		state := getQueryParam(t, authURL, "state")
+
+		// set provider claims that will be returned by the mock server
+		s.customClaims = map[string]interface{}{
+			"nonce": "notgonnamatch",
+			"email": "bob@example.com",
+			"COLOR": "green",
+			"sk":    "42",
+			"nested": map[string]interface{}{
+				"Size":        "medium",
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+
+		// set mock provider's expected code
+		s.code = "abc"
+
+		// invoke the callback, which will in to try to exchange the code
+		// with the mock provider.
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": state,
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.IsError() {
+			t.Fatalf("expected error response, got: %v", resp.Data)
+		}
+		assertErrorCode(t, resp, "nonce_mismatch")
+	})
+
+	t.Run("skip nonce", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		for _, skipNonce := range []bool{false, true} {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/test",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"oidc_skip_nonce": skipNonce,
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+			if skipNonce && (resp == nil || len(resp.Warnings) == 0) {
+				t.Fatalf("expected a warning, got: %#v", resp)
+			}
+
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+			if strings.Contains(authURL, "nonce=") == skipNonce {
+				t.Fatalf("oidc_skip_nonce %t: unexpected auth_url: %s", skipNonce, authURL)
+			}
+
+			// the provider does not return a nonce
+			s.customClaims = map[string]interface{}{
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.IsError() == skipNonce {
+				t.Fatalf("oidc_skip_nonce %t: unexpected response: %#v", skipNonce, resp)
+			}
+			if !skipNonce {
+				assertErrorCode(t, resp, "nonce_mismatch")
+			}
+		}
+	})
+
+	t.Run("concurrent callbacks", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// the nonce is skipped so that all logins can share the mock's claims
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_skip_nonce": true,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		var states []string
+		for i := 0; i < 20; i++ {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+			states = append(states, getQueryParam(t, resp.Data["auth_url"].(string), "state"))
+		}
+
+		s.customClaims = map[string]interface{}{
+			"email": "bob@example.com",
+			"sk":    "42",
+			"nested": map[string]interface{}{
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+		s.code = "abc"
+
+		// drop the cached config and provider so that the callbacks race to
+		// load them
+		b.(*jwtAuthBackend).reset()
+		discoveries := atomic.LoadInt32(&s.discoveryRequests)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, len(states))
+		for _, state := range states {
+			wg.Add(1)
+			go func(state string) {
+				defer wg.Done()
+
+				req := &logical.Request{
+					Operation: logical.ReadOperation,
+					Path:      "oidc/callback",
+					Storage:   storage,
+					Data: map[string]interface{}{
+						"state": state,
+						"code":  "abc",
+					},
+				}
+
+				resp, err := b.HandleRequest(context.Background(), req)
+				if err == nil && resp.IsError() {
+					err = resp.Error()
+				}
+				errs <- err
+			}(state)
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n := atomic.LoadInt32(&s.discoveryRequests) - discoveries; n != 1 {
+			t.Fatalf("expected a single discovery request, got %d", n)
+		}
+	})
+
+	t.Run("re-discovery after token endpoint moves", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		login := func() *logical.Response {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		if resp := login(); resp.IsError() {
+			t.Fatalf("unexpected error: %v", resp.Error())
+		}
+
+		// The backend recovers by re-discovering the moved endpoint
+		s.movedTokenPath = "/v2/token"
+		discoveries := atomic.LoadInt32(&s.discoveryRequests)
+
+		if resp := login(); resp.IsError() {
+			t.Fatalf("unexpected error: %v", resp.Error())
+		}
+		if n := atomic.LoadInt32(&s.discoveryRequests) - discoveries; n != 1 {
+			t.Fatalf("expected 1 discovery request, got %d", n)
+		}
+
+		// Re-discovery is not repeated within the minimum interval
+		s.movedTokenPath = "/v3/token"
+		discoveries = atomic.LoadInt32(&s.discoveryRequests)
+
+		resp := login()
+		assertErrorCode(t, resp, errCodeExchangeFailed)
+		if n := atomic.LoadInt32(&s.discoveryRequests) - discoveries; n != 0 {
+			t.Fatalf("expected no discovery requests, got %d", n)
+		}
+	})
+
+	t.Run("token request timeout is not re-sent", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_request_timeout": "1s",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		s.code = "abc"
+		s.tokenDelay = 2 * time.Second
+		discoveries := atomic.LoadInt32(&s.discoveryRequests)
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": getQueryParam(t, authURL, "state"),
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertErrorCode(t, resp, errCodeExchangeFailed)
+
+		if n := atomic.LoadInt32(&s.tokenRequests); n != 1 {
+			t.Fatalf("expected 1 token request, got %d", n)
+		}
+		if n := atomic.LoadInt32(&s.discoveryRequests) - discoveries; n != 0 {
+			t.Fatalf("expected no discovery requests, got %d", n)
+		}
+	})
+
+	t.Run("re-discovery only after JWKS is not found", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		login := func() *logical.Response {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		for _, test := range []struct {
+			jwksStatus  int
+			discoveries int32
+		}{
+			{500, 0},
+			{404, 1},
+		} {
+			s.jwksStatus = test.jwksStatus
+			discoveries := atomic.LoadInt32(&s.discoveryRequests)
+
+			assertErrorCode(t, login(), errCodeTokenInvalid)
+			if n := atomic.LoadInt32(&s.discoveryRequests) - discoveries; n != test.discoveries {
+				t.Fatalf("JWKS status %d: expected %d discovery requests, got %d", test.jwksStatus, test.discoveries, n)
+			}
+		}
+	})
+
+	t.Run("role selection by claim", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		for _, roleName := range []string{"other", "admin"} {
+			req := &logical.Request{
+				Operation: logical.CreateOperation,
+				Path:      "role/" + roleName,
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"user_claim":            "email",
+					"allowed_redirect_uris": []string{"https://example.com"},
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+		}
+
+		// The claim is only used if no default role applies
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"default_role":             "",
+				"role_claim":               "vault_role",
+				"role_claim_allowed_roles": "test,other",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		login := func(claimedRole string) *logical.Response {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce":      getQueryParam(t, authURL, "nonce"),
+				"email":      "bob@example.com",
+				"sk":         "42",
+				"vault_role": claimedRole,
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		// An allowed role is selected
+		resp = login("Other")
+		if resp.IsError() {
+			t.Fatalf("unexpected error: %v", resp.Error())
+		}
+		if role := resp.Auth.Metadata["role"]; role != "other" {
+			t.Fatalf("expected role %q, got %q", "other", role)
+		}
+
+		// A role that isn't allowed can't be selected
+		resp = login("admin")
+		assertErrorCode(t, resp, errCodeRoleNotAllowed)
+
+		// The default role takes precedence over the claim
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"default_role": "test",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		resp = login("other")
+		if resp.IsError() {
+			t.Fatalf("unexpected error: %v", resp.Error())
+		}
+		if role := resp.Auth.Metadata["role"]; role != "test" {
+			t.Fatalf("expected role %q, got %q", "test", role)
+		}
+	})
+
+	t.Run("role from auth_url is authoritative", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// a role without bound claims, which the token below would satisfy
+		req := &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "role/lax",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"user_claim":            "email",
+				"allowed_redirect_uris": []string{"https://example.com"},
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		for _, test := range []struct {
+			name         string
+			callbackRole string
+			sk           string
+			errCode      string
+		}{
+			{"switch role", "lax", "43", "role_mismatch"},
+			{"no role", "", "43", "bound_claim_failed"},
+			{"matching role", "test", "42", ""},
+			{"matching role, bound claim mismatch", "TEST", "43", "bound_claim_failed"},
+		} {
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    test.sk,
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			data := map[string]interface{}{
+				"state": getQueryParam(t, authURL, "state"),
+				"code":  "abc",
+			}
+			if test.callbackRole != "" {
+				data["role"] = test.callbackRole
+			}
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data:      data,
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.errCode == "" {
+				if resp.IsError() {
+					t.Fatalf("case %q: unexpected error response: %v", test.name, resp.Error())
+				}
+				if resp.Auth.Metadata["role"] != "test" {
+					t.Fatalf("case %q: expected role %q, got: %q", test.name, "test", resp.Auth.Metadata["role"])
+				}
+				continue
+			}
+			if !resp.IsError() {
+				t.Fatalf("case %q: expected error response, got: %#v", test.name, resp)
+			}
+			assertErrorCode(t, resp, test.errCode)
+		}
+	})
+
+	t.Run("bound claims on access token", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// the authorization data is only present in the access token
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"bound_claims_token": "access_token",
+				"bound_claims": map[string]interface{}{
+					"scp": "vault.login",
+				},
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		// an access token signed by the provider, with its payload replaced
+		validToken, _ := getTestJWT(t, ecdsaPrivKey, jwt.Claims{Issuer: s.server.URL}, map[string]interface{}{"scp": "none"})
+		forgedToken, _ := getTestJWT(t, ecdsaPrivKey, jwt.Claims{Issuer: s.server.URL}, map[string]interface{}{"scp": "vault.login"})
+		validParts, forgedParts := strings.Split(validToken, "."), strings.Split(forgedToken, ".")
+		tamperedToken := strings.Join([]string{validParts[0], forgedParts[1], validParts[2]}, ".")
+
+		// a correctly signed access token that never expires
+		unexpiringToken, _ := getTestJWT(t, ecdsaPrivKey, jwt.Claims{
+			Issuer:    s.server.URL,
+			NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
+		}, map[string]interface{}{"scp": "vault.login"})
+
+		for _, test := range []struct {
+			name         string
+			idClaims     map[string]interface{}
+			accessClaims map[string]interface{}
+			accessToken  string
+			errCode      string
+		}{
+			{"claim in access token", nil, map[string]interface{}{"scp": "vault.login"}, "", ""},
+			{"claim only in ID token", map[string]interface{}{"scp": "vault.login"}, map[string]interface{}{"scp": "other"}, "", "bound_claim_failed"},
+			{"opaque access token", nil, nil, "2YotnFZFEjr1zCsicMWpAA", "token_invalid"},
+			{"tampered access token", nil, nil, tamperedToken, "token_invalid"},
+			{"access token without exp", nil, nil, unexpiringToken, "token_invalid"},
+		} {
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"nested": map[string]interface{}{
+					"Groups": []string{"a", "b"},
+				},
+			}
+			for k, v := range test.idClaims {
+				s.customClaims[k] = v
+			}
+			s.accessTokenClaims = test.accessClaims
+			s.accessToken = test.accessToken
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.errCode == "" {
+				if resp.IsError() {
+					t.Fatalf("case %q: unexpected error response: %v", test.name, resp.Error())
+				}
+				continue
+			}
+			if !resp.IsError() {
+				t.Fatalf("case %q: expected error response, got: %#v", test.name, resp)
+			}
+			assertErrorCode(t, resp, test.errCode)
+		}
+
+		// only OIDC roles receive an access token
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role_type":       "jwt",
+				"bound_audiences": "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "bound_claims_token") {
+			t.Fatalf("expected error response, got: %#v", resp)
+		}
+	})
+
+	t.Run("failed login - bound claim mismatch", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// get auth_url
+		data := map[string]interface{}{
+			"role":         "test",
+			"redirect_uri": "https://example.com",
+		}
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data:      data,
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		state := getQueryParam(t, authURL, "state")
+		nonce := getQueryParam(t, authURL, "nonce")
+
+		// set provider claims that will be returned by the mock server
+		s.customClaims = map[string]interface{}{
+			"nonce": nonce,
+			"email": "bob@example.com",
+			"COLOR": "green",
+			"sk":    "43", // the pre-configured role has a bound claim of "sk"=="42"
+			"nested": map[string]interface{}{
+				"Size":        "medium",
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+
+		// set mock provider's expected code
+		s.code = "abc"
+
+		// invoke the callback, which will in to try to exchange the code
+		// with the mock provider.
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": state,
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.IsError() {
+			t.Fatalf("expected error response, got: %v", resp.Data)
+		}
+		assertErrorCode(t, resp, "bound_claim_failed")
+	})
+
+	t.Run("additional audiences", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		for _, test := range []struct {
+			name                string
+			additionalAudiences []string
+			tokenAudience       string
+			errExpected         bool
+		}{
+			{"client ID only", nil, "abc", false},
+			{"other client ID not accepted by default", nil, "other", true},
+			{"primary client ID", []string{"other", "another"}, "abc", false},
+			{"additional client ID", []string{"other", "another"}, "another", false},
+			{"unknown client ID", []string{"other", "another"}, "unknown", true},
+		} {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      configPath,
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"oidc_discovery_url":        s.server.URL,
+					"oidc_client_id":            "abc",
+					"oidc_client_secret":        "def",
+					"oidc_additional_audiences": test.additionalAudiences,
+					"default_role":              "test",
+					"bound_issuer":              "http://vault.example.com/",
+					"jwt_supported_algs":        []string{"ES256"},
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.clientID = test.tokenAudience
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.IsError() != test.errExpected {
+				t.Fatalf("case %q: expected error: %t, got: %#v", test.name, test.errExpected, resp)
+			}
+		}
+	})
+
+	t.Run("periodic token", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"period": "4m",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		s.customClaims = map[string]interface{}{
+			"nonce": getQueryParam(t, authURL, "nonce"),
+			"email": "bob@example.com",
+			"sk":    "42",
+			"nested": map[string]interface{}{
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+		s.code = "abc"
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": getQueryParam(t, authURL, "state"),
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+		if resp.Auth.Period != 4*time.Minute {
+			t.Fatalf("unexpected period: %v", resp.Auth.Period)
+		}
+
+		// renewals pick up the role's current period
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"period": "2m",
+			},
+		}
+
+		resp2, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp2 != nil && resp2.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp2)
+		}
+
+		req = &logical.Request{
+			Operation: logical.RenewOperation,
+			Path:      "login",
+			Storage:   storage,
+			Auth:      resp.Auth,
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+		if resp.Auth.Period != 2*time.Minute {
+			t.Fatalf("unexpected period after renewal: %v", resp.Auth.Period)
+		}
+	})
+
+	t.Run("bound token ttl", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// the role grants 3m, but the mock provider's tokens expire in 5s
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"bound_token_ttl": true,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		s.customClaims = map[string]interface{}{
+			"nonce": getQueryParam(t, authURL, "nonce"),
+			"email": "bob@example.com",
+			"sk":    "42",
+			"nested": map[string]interface{}{
+				"Groups":      []string{"a", "b"},
+				"secret_code": "bar",
+			},
+			"password": "foo",
+		}
+		s.code = "abc"
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": getQueryParam(t, authURL, "state"),
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+		if resp.Auth.TTL > 5*time.Second || resp.Auth.MaxTTL > 5*time.Second {
+			t.Fatalf("expected TTLs capped at the token expiry, got ttl %v, max_ttl %v", resp.Auth.TTL, resp.Auth.MaxTTL)
+		}
+
+		// renewals stay capped as well
+		req = &logical.Request{
+			Operation: logical.RenewOperation,
+			Path:      "login",
+			Storage:   storage,
+			Auth:      resp.Auth,
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+		if resp.Auth.TTL > 5*time.Second || resp.Auth.MaxTTL > 5*time.Second {
+			t.Fatalf("expected renewed TTLs capped at the token expiry, got ttl %v, max_ttl %v", resp.Auth.TTL, resp.Auth.MaxTTL)
+		}
+	})
+
+	t.Run("expose id_token", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		for _, expose := range []bool{false, true} {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/test",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"expose_id_token": expose,
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			idToken, ok := resp.Auth.Metadata["id_token"]
+			if ok != expose {
+				t.Fatalf("expose_id_token %t: unexpected id_token metadata: %v", expose, resp.Auth.Metadata)
+			}
+			if expose && strings.Count(idToken, ".") != 2 {
+				t.Fatalf("expected a compact JWT, got %q", idToken)
+			}
+		}
+	})
+
+	t.Run("client auth methods", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		block, _ := pem.Decode([]byte(ecdsaPubKey))
+		signingPubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		noBasicAuth := func(r *http.Request) error {
+			if _, _, ok := r.BasicAuth(); ok {
+				return errors.New("unexpected basic auth")
+			}
+			return nil
+		}
+
+		tests := []struct {
+			method string
+			check  func(r *http.Request) error
+		}{
+			{
+				"client_secret_basic",
+				func(r *http.Request) error {
+					if id, secret, ok := r.BasicAuth(); !ok || id != "abc" || secret != "def" {
+						return fmt.Errorf("unexpected basic auth: %q %q", id, secret)
+					}
+					if r.PostForm.Get("client_secret") != "" {
+						return errors.New("unexpected client_secret parameter")
+					}
+					return nil
+				},
+			},
+			{
+				"client_secret_post",
+				func(r *http.Request) error {
+					if r.PostForm.Get("client_id") != "abc" || r.PostForm.Get("client_secret") != "def" {
+						return fmt.Errorf("unexpected client credentials: %v", r.PostForm)
+					}
+					return noBasicAuth(r)
+				},
+			},
+			{
+				"none",
+				func(r *http.Request) error {
+					if r.PostForm.Get("client_id") != "abc" || r.PostForm.Get("client_secret") != "" {
+						return fmt.Errorf("unexpected client credentials: %v", r.PostForm)
+					}
+					return noBasicAuth(r)
+				},
+			},
+			{
+				"private_key_jwt",
+				func(r *http.Request) error {
+					if r.PostForm.Get("client_secret") != "" {
+						return errors.New("unexpected client_secret parameter")
+					}
+					if r.PostForm.Get("client_assertion_type") != clientAssertionType {
+						return fmt.Errorf("unexpected client_assertion_type: %q", r.PostForm.Get("client_assertion_type"))
+					}
+					assertion, err := jwt.ParseSigned(r.PostForm.Get("client_assertion"))
+					if err != nil {
+						return err
+					}
+					var claims jwt.Claims
+					if err := assertion.Claims(signingPubKey, &claims); err != nil {
+						return err
+					}
+					return claims.Validate(jwt.Expected{
+						Issuer:   "abc",
+						Subject:  "abc",
+						Audience: jwt.Audience{s.server.URL + "/token"},
+						Time:     time.Now(),
+					})
+				},
+			},
+		}
+
+		for _, test := range tests {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      configPath,
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"oidc_client_auth_method": test.method,
+					"oidc_client_signing_key": ecdsaPrivKey,
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+			s.tokenAuth = test.check
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("%s: err:%v resp:%#v\n", test.method, err, resp)
+			}
+		}
+	})
+
+	t.Run("default client auth method sends the code once", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+
+		// the provider only accepts client_secret_post, so the request with
+		// basic auth is rejected and must not be retried with other credentials
+		s.code = "abc"
+		s.tokenAuth = func(r *http.Request) error {
+			if r.PostForm.Get("client_secret") != "def" {
+				return errors.New("missing client_secret parameter")
+			}
+			return nil
+		}
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": getQueryParam(t, authURL, "state"),
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertErrorCode(t, resp, errCodeExchangeFailed)
+		if n := atomic.LoadInt32(&s.tokenRequests); n != 1 {
+			t.Fatalf("expected 1 token request, got %d", n)
+		}
+	})
+
+	t.Run("require email_verified", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_require_email_verified": true,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		for _, test := range []struct {
+			name          string
+			emailVerified interface{}
+			errExpected   bool
+		}{
+			{"verified", true, false},
+			{"verified string", "true", false},
+			{"unverified", false, true},
+			{"missing", nil, true},
+		} {
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			if test.emailVerified != nil {
+				s.customClaims["email_verified"] = test.emailVerified
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.IsError() != test.errExpected {
+				t.Fatalf("case %q: expected error: %t, got: %#v", test.name, test.errExpected, resp)
+			}
+			if test.errExpected && !strings.Contains(resp.Error().Error(), "email_verified") {
+				t.Fatalf("case %q: unexpected error: %v", test.name, resp.Error())
+			}
+			if test.errExpected {
+				assertErrorCode(t, resp, "email_not_verified")
+			}
+		}
+	})
+
+	t.Run("role bound_subject", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		for _, test := range []struct {
+			subject     string
+			errExpected bool
+		}{
+			// the mock provider always issues tokens with this subject
+			{"r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients", false},
+			{"service-account@clients", true},
+		} {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/test",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"bound_subject": test.subject,
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.IsError() != test.errExpected {
+				t.Fatalf("subject %q: expected error: %t, got: %#v", test.subject, test.errExpected, resp)
+			}
+			if test.errExpected && !strings.Contains(resp.Error().Error(), "sub claim does not match bound subject") {
+				t.Fatalf("subject %q: unexpected error: %v", test.subject, resp.Error())
+			}
+			if test.errExpected {
+				assertErrorCode(t, resp, "token_invalid")
+			}
+		}
+	})
+
+	t.Run("role bound_audiences_strict", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		for _, test := range []struct {
+			strict         bool
+			boundAudiences string
+			errExpected    bool
+		}{
+			// the mock provider issues tokens with the client ID as audience
+			{false, "", false},
+			{true, "", true},
+			{true, "abc", false},
+		} {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/test",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"bound_audiences":        test.boundAudiences,
+					"bound_audiences_strict": test.strict,
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.IsError() != test.errExpected {
+				t.Fatalf("strict %t, bound_audiences %q: expected error: %t, got: %#v", test.strict, test.boundAudiences, test.errExpected, resp)
+			}
+			if test.errExpected && !strings.Contains(resp.Error().Error(), "no audiences bound to the role") {
+				t.Fatalf("unexpected error: %v", resp.Error())
+			}
+		}
+	})
+
+	t.Run("role bound_issuer", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		for _, test := range []struct {
+			issuer      string
+			tokenIssuer string
+			errExpected bool
+		}{
+			{s.server.URL, "", false},
+			// trailing slashes are ignored when comparing issuers
+			{s.server.URL + "/", "", false},
+			{s.server.URL, s.server.URL + "/", false},
+			{"https://other-idp.example.com", "", true},
+		} {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/test",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"bound_issuer": test.issuer,
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+			s.tokenIssuer = test.tokenIssuer
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.IsError() != test.errExpected {
+				t.Fatalf("issuer %q: expected error: %t, got: %#v", test.issuer, test.errExpected, resp)
+			}
+			if test.errExpected && !strings.Contains(resp.Error().Error(), "bound issuer") {
+				t.Fatalf("issuer %q: unexpected error: %v", test.issuer, resp.Error())
+			}
+			if test.errExpected {
+				assertErrorCode(t, resp, "token_invalid")
+			}
+		}
+	})
+
+	t.Run("acr enforcement", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"bound_acr": "phr,phrh",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		for _, test := range []struct {
+			acr         interface{}
+			errExpected string
+		}{
+			{"phrh", ""},
+			{"pwd", `expected one of ["phr" "phrh"], got "pwd"`},
+			{nil, "acr claim is missing"},
+		} {
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
+
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			if test.acr != nil {
+				s.customClaims["acr"] = test.acr
+			}
+			s.code = "abc"
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.errExpected == "" {
+				if resp.IsError() {
+					t.Fatalf("acr %v: unexpected error response: %v", test.acr, resp.Data)
+				}
+				continue
+			}
+			if !resp.IsError() || !strings.Contains(resp.Error().Error(), test.errExpected) {
+				t.Fatalf("acr %v: expected error containing %q, got: %#v", test.acr, test.errExpected, resp)
+			}
+			assertErrorCode(t, resp, "token_invalid")
 		}
 	})
 
-	t.Run("failed login - bad nonce", func(t *testing.T) {
+	t.Run("retries and timeouts", func(t *testing.T) {
 		b, storage, s := getBackendAndServer(t)
 		defer s.server.Close()
 
-		// get auth_url
-		data := map[string]interface{}{
-			"role":         "test",
-			"redirect_uri": "https://example.com",
-		}
 		req := &logical.Request{
 			Operation: logical.UpdateOperation,
-			Path:      "oidc/auth_url",
+			Path:      configPath,
 			Storage:   storage,
-			Data:      data,
+			Data: map[string]interface{}{
+				"oidc_discovery_url":   s.server.URL,
+				"oidc_client_id":       "abc",
+				"oidc_client_secret":   "def",
+				"default_role":         "test",
+				"jwt_supported_algs":   []string{"ES256"},
+				"oidc_request_timeout": "1s",
+				"oidc_max_retries":     2,
+			},
 		}
 
 		resp, err := b.HandleRequest(context.Background(), req)
@@ -387,110 +4206,190 @@ func TestOIDC_Callback(t *testing.T) {
 			t.Fatalf("err:%v resp:%#v\n", err, resp)
 		}
 
-		authURL := resp.Data["auth_url"].(string)
+		for _, test := range []struct {
+			name          string
+			tokenFailures int
+			tokenDelay    time.Duration
+			errExpected   string
+		}{
+			{"token request not retried", 1, 0, "503"},
+			{"timeout", 0, 2 * time.Second, "context deadline exceeded"},
+		} {
+			req = &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "oidc/auth_url",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"role":         "test",
+					"redirect_uri": "https://example.com",
+				},
+			}
 
-		state := getQueryParam(t, authURL, "state")
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("err:%v resp:%#v\n", err, resp)
+			}
 
-		// set provider claims that will be returned by the mock server
-		s.customClaims = map[string]interface{}{
-			"nonce": "notgonnamatch",
-			"email": "bob@example.com",
-			"COLOR": "green",
-			"sk":    "42",
-			"nested": map[string]interface{}{
-				"Size":        "medium",
-				"Groups":      []string{"a", "b"},
-				"secret_code": "bar",
-			},
-			"password": "foo",
+			authURL := resp.Data["auth_url"].(string)
+
+			s.customClaims = map[string]interface{}{
+				"nonce": getQueryParam(t, authURL, "nonce"),
+				"email": "bob@example.com",
+				"sk":    "42",
+				"nested": map[string]interface{}{
+					"Groups":      []string{"a", "b"},
+					"secret_code": "bar",
+				},
+				"password": "foo",
+			}
+			s.code = "abc"
+			s.tokenFailures = test.tokenFailures
+			s.tokenDelay = test.tokenDelay
+
+			req = &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "oidc/callback",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"state": getQueryParam(t, authURL, "state"),
+					"code":  "abc",
+				},
+			}
+
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.errExpected == "" {
+				if resp.IsError() {
+					t.Fatalf("case %q: unexpected error response: %v", test.name, resp.Error())
+				}
+				continue
+			}
+			if !resp.IsError() || !strings.Contains(resp.Error().Error(), test.errExpected) {
+				t.Fatalf("case %q: expected error containing %q, got: %#v", test.name, test.errExpected, resp)
+			}
+			assertErrorCode(t, resp, "exchange_failed")
+			if s.tokenFailures != 0 {
+				t.Fatalf("case %q: expected the token request to be sent once", test.name)
+			}
 		}
+	})
 
-		// set mock provider's expected code
-		s.code = "abc"
+	t.Run("custom request headers", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
 
-		// invoke the callback, which will in to try to exchange the code
-		// with the mock provider.
-		req = &logical.Request{
-			Operation: logical.ReadOperation,
-			Path:      "oidc/callback",
-			Storage:   storage,
-			Data: map[string]interface{}{
-				"state": state,
-				"code":  "abc",
-			},
+		s.requiredHeaders = map[string]string{"X-Api-Key": "secret"}
+
+		config := map[string]interface{}{
+			"oidc_discovery_url": s.server.URL,
+			"oidc_client_id":     "abc",
+			"oidc_client_secret": "def",
+			"default_role":       "test",
+			"jwt_supported_algs": []string{"ES256"},
 		}
 
-		resp, err = b.HandleRequest(context.Background(), req)
+		// discovery is rejected without the header
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data:      config,
+		}
 
+		resp, err := b.HandleRequest(context.Background(), req)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if !resp.IsError() {
-			t.Fatalf("expected error response, got: %v", resp.Data)
+		if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "401") {
+			t.Fatalf("expected discovery error, got: %#v", resp)
 		}
-	})
 
-	t.Run("failed login - bound claim mismatch", func(t *testing.T) {
-		b, storage, s := getBackendAndServer(t)
-		defer s.server.Close()
+		// invalid header names and values are rejected
+		for _, headers := range []map[string]interface{}{
+			{"x api key": "secret"},
+			{"x-api-key": "secret\r\nX-Injected: true"},
+		} {
+			config["oidc_request_headers"] = headers
+			resp, err = b.HandleRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "invalid header") {
+				t.Fatalf("expected invalid header error for %v, got: %#v", headers, resp)
+			}
+		}
 
-		// get auth_url
-		data := map[string]interface{}{
-			"role":         "test",
-			"redirect_uri": "https://example.com",
+		config["oidc_request_headers"] = map[string]interface{}{"x-api-key": "secret"}
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
 		}
-		req := &logical.Request{
+
+		// the header value is not disclosed
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      configPath,
+			Storage:   storage,
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+		expectedHeaders := map[string]string{"X-Api-Key": "redacted"}
+		if diff := deep.Equal(resp.Data["oidc_request_headers"], expectedHeaders); diff != nil {
+			t.Fatal(diff)
+		}
+
+		req = &logical.Request{
 			Operation: logical.UpdateOperation,
 			Path:      "oidc/auth_url",
 			Storage:   storage,
-			Data:      data,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
 		}
 
-		resp, err := b.HandleRequest(context.Background(), req)
+		resp, err = b.HandleRequest(context.Background(), req)
 		if err != nil || (resp != nil && resp.IsError()) {
 			t.Fatalf("err:%v resp:%#v\n", err, resp)
 		}
 
 		authURL := resp.Data["auth_url"].(string)
 
-		state := getQueryParam(t, authURL, "state")
-		nonce := getQueryParam(t, authURL, "nonce")
-
-		// set provider claims that will be returned by the mock server
 		s.customClaims = map[string]interface{}{
-			"nonce": nonce,
+			"nonce": getQueryParam(t, authURL, "nonce"),
 			"email": "bob@example.com",
-			"COLOR": "green",
-			"sk":    "43", // the pre-configured role has a bound claim of "sk"=="42"
+			"sk":    "42",
 			"nested": map[string]interface{}{
-				"Size":        "medium",
 				"Groups":      []string{"a", "b"},
 				"secret_code": "bar",
 			},
 			"password": "foo",
 		}
-
-		// set mock provider's expected code
 		s.code = "abc"
 
-		// invoke the callback, which will in to try to exchange the code
-		// with the mock provider.
+		// the token, JWKS and userinfo requests also carry the header
 		req = &logical.Request{
 			Operation: logical.ReadOperation,
 			Path:      "oidc/callback",
 			Storage:   storage,
 			Data: map[string]interface{}{
-				"state": state,
+				"state": getQueryParam(t, authURL, "state"),
 				"code":  "abc",
 			},
 		}
 
 		resp, err = b.HandleRequest(context.Background(), req)
-		if err != nil {
-			t.Fatal(err)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
 		}
-		if !resp.IsError() {
-			t.Fatalf("expected error response, got: %v", resp.Data)
+		if resp.Auth == nil || resp.Auth.Alias.Name != "bob@example.com" {
+			t.Fatalf("unexpected auth: %#v", resp.Auth)
 		}
 	})
 
@@ -511,6 +4410,7 @@ func TestOIDC_Callback(t *testing.T) {
 		if resp == nil || !strings.Contains(resp.Error().Error(), "Expired or missing OAuth state") {
 			t.Fatalf("expected OAuth state error response, got: %#v", resp)
 		}
+		assertErrorCode(t, resp, "state_expired")
 	})
 
 	t.Run("unknown state", func(t *testing.T) {
@@ -533,6 +4433,80 @@ func TestOIDC_Callback(t *testing.T) {
 		if resp == nil || !strings.Contains(resp.Error().Error(), "Expired or missing OAuth state") {
 			t.Fatalf("expected OAuth state error response, got: %#v", resp)
 		}
+		assertErrorCode(t, resp, "state_expired")
+	})
+
+	t.Run("expired state", func(t *testing.T) {
+		b, storage, s := getBackendAndServer(t)
+		defer s.server.Close()
+
+		// shorten the state lifetime
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"oidc_discovery_url": s.server.URL,
+				"oidc_client_id":     "abc",
+				"oidc_client_secret": "def",
+				"default_role":       "test",
+				"bound_issuer":       "http://vault.example.com/",
+				"jwt_supported_algs": []string{"ES256"},
+				"oidc_state_ttl":     "1s",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "oidc/auth_url",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":         "test",
+				"redirect_uri": "https://example.com",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v\n", err, resp)
+		}
+
+		authURL := resp.Data["auth_url"].(string)
+		state := getQueryParam(t, authURL, "state")
+
+		time.Sleep(1100 * time.Millisecond)
+
+		// expired states are reaped from memory
+		states := b.(*jwtAuthBackend).oidcStates
+		states.DeleteExpired()
+		if count := states.ItemCount(); count != 0 {
+			t.Fatalf("expected expired state to be reaped, found %d states", count)
+		}
+
+		s.code = "abc"
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "oidc/callback",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"state": state,
+				"code":  "abc",
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil || !strings.Contains(resp.Error().Error(), "Expired or missing OAuth state") {
+			t.Fatalf("expected OAuth state error response, got: %#v", resp)
+		}
+		assertErrorCode(t, resp, "state_expired")
 	})
 
 	t.Run("valid state, missing code", func(t *testing.T) {
@@ -575,6 +4549,7 @@ func TestOIDC_Callback(t *testing.T) {
 		if resp == nil || !strings.Contains(resp.Error().Error(), "code parameter not provided") {
 			t.Fatalf("expected OAuth core error response, got: %#v", resp)
 		}
+		assertErrorCode(t, resp, "code_missing")
 	})
 
 	t.Run("failed code exchange", func(t *testing.T) {
@@ -621,6 +4596,7 @@ func TestOIDC_Callback(t *testing.T) {
 		if resp == nil || !strings.Contains(resp.Error().Error(), "cannot fetch token") {
 			t.Fatalf("expected code exchange error response, got: %#v", resp)
 		}
+		assertErrorCode(t, resp, "exchange_failed")
 	})
 
 	t.Run("no response from provider", func(t *testing.T) {
@@ -667,18 +4643,54 @@ func TestOIDC_Callback(t *testing.T) {
 		if resp == nil || !strings.Contains(resp.Error().Error(), "connection refused") {
 			t.Fatalf("expected code exchange error response, got: %#v", resp)
 		}
+		assertErrorCode(t, resp, "exchange_failed")
 	})
 }
 
 // oidcProvider is local server the mocks the basis endpoints used by the
 // OIDC callback process.
 type oidcProvider struct {
-	t            *testing.T
-	server       *httptest.Server
-	clientID     string
-	clientSecret string
-	code         string
-	customClaims map[string]interface{}
+	t             *testing.T
+	server        *httptest.Server
+	clientID      string
+	clientSecret  string
+	code          string
+	codeChallenge string
+	customClaims  map[string]interface{}
+	userinfo      map[string]interface{}
+	userinfoError bool
+	tokenFailures int
+	tokenDelay    time.Duration
+	tokenIssuer   string
+	tokenAuth     func(r *http.Request) error
+
+	// requiredHeaders, if set, must be sent with every request.
+	requiredHeaders map[string]string
+
+	// endSessionEndpoint, if set, is the path advertised as the
+	// end_session_endpoint.
+	endSessionEndpoint string
+
+	// accessTokenClaims, if set, are the claims of a JWT access token issued
+	// separately from the ID token, which is otherwise also returned as the
+	// access token. accessToken, if set, is returned verbatim instead.
+	accessTokenClaims map[string]interface{}
+	accessToken       string
+
+	// noExpiry, if set, omits the exp claim from issued tokens.
+	noExpiry bool
+
+	// movedTokenPath, if set, is advertised as the token endpoint and any
+	// other token endpoint is no longer found.
+	movedTokenPath string
+
+	// jwksStatus, if set, is the status returned by the JWKS endpoint instead
+	// of the keys.
+	jwksStatus int
+
+	discoveryRequests int32
+	tokenRequests     int32
+	userinfoRequests  int32
 }
 
 func newOIDCProvider(t *testing.T) *oidcProvider {
@@ -692,47 +4704,127 @@ func newOIDCProvider(t *testing.T) *oidcProvider {
 func (o *oidcProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	switch r.URL.Path {
+	for name, value := range o.requiredHeaders {
+		if r.Header.Get(name) != value {
+			w.WriteHeader(401)
+			return
+		}
+	}
+
+	path := r.URL.Path
+	tokenPath := "/token"
+	if o.movedTokenPath != "" {
+		switch {
+		case path == o.movedTokenPath:
+			path = "/token"
+		case strings.HasSuffix(path, "/token"):
+			w.WriteHeader(404)
+			return
+		}
+		tokenPath = o.movedTokenPath
+	}
+
+	switch path {
 	case "/.well-known/openid-configuration":
+		atomic.AddInt32(&o.discoveryRequests, 1)
+		endSession := ""
+		if o.endSessionEndpoint != "" {
+			endSession = `,
+				"end_session_endpoint": "%s` + o.endSessionEndpoint + `"`
+		}
 		w.Write([]byte(strings.Replace(`
 			{
 				"issuer": "%s",
 				"authorization_endpoint": "%s/auth",
-				"token_endpoint": "%s/token",
+				"token_endpoint": "%s`+tokenPath+`",
 				"jwks_uri": "%s/certs",
-				"userinfo_endpoint": "%s/userinfo"
+				"userinfo_endpoint": "%s/userinfo"`+endSession+`
 			}`, "%s", o.server.URL, -1)))
 	case "/certs":
+		if o.jwksStatus != 0 {
+			w.WriteHeader(o.jwksStatus)
+			break
+		}
 		a := getTestJWKS(o.t, ecdsaPubKey)
 		w.Write(a)
 
 	case "/token":
+		atomic.AddInt32(&o.tokenRequests, 1)
+		if o.tokenFailures > 0 {
+			o.tokenFailures--
+			w.WriteHeader(503)
+			break
+		}
+		time.Sleep(o.tokenDelay)
+
 		code := r.FormValue("code")
 
+		if o.tokenAuth != nil {
+			if err := o.tokenAuth(r); err != nil {
+				o.t.Logf("token endpoint client authentication failed: %s", err)
+				w.WriteHeader(401)
+				break
+			}
+		}
+
 		if code != o.code {
 			w.WriteHeader(401)
 			break
 		}
 
+		if o.codeChallenge != "" && codeChallengeS256(r.FormValue("code_verifier")) != o.codeChallenge {
+			w.WriteHeader(401)
+			break
+		}
+
+		issuer := o.server.URL
+		if o.tokenIssuer != "" {
+			issuer = o.tokenIssuer
+		}
+
 		stdClaims := jwt.Claims{
 			Subject:   "r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
-			Issuer:    o.server.URL,
+			Issuer:    issuer,
 			NotBefore: jwt.NewNumericDate(time.Now().Add(-5 * time.Second)),
 			Expiry:    jwt.NewNumericDate(time.Now().Add(5 * time.Second)),
 			Audience:  jwt.Audience{o.clientID},
 		}
+		if o.noExpiry {
+			stdClaims.Expiry = nil
+		}
 		jwtData, _ := getTestJWT(o.t, ecdsaPrivKey, stdClaims, o.customClaims)
+
+		accessToken := jwtData
+		if o.accessTokenClaims != nil {
+			stdClaims.Audience = jwt.Audience{"https://api.example.com"}
+			accessToken, _ = getTestJWT(o.t, ecdsaPrivKey, stdClaims, o.accessTokenClaims)
+		}
+		if o.accessToken != "" {
+			accessToken = o.accessToken
+		}
+
 		w.Write([]byte(fmt.Sprintf(`
 			{
 				"access_token":"%s",
 				"id_token":"%s"
 			}`,
-			jwtData,
+			accessToken,
 			jwtData,
 		)))
 	case "/userinfo":
+		atomic.AddInt32(&o.userinfoRequests, 1)
+		if o.userinfoError {
+			w.WriteHeader(500)
+			break
+		}
+		if o.userinfo != nil {
+			data, _ := json.Marshal(o.userinfo)
+			w.Write(data)
+			break
+		}
 		w.Write([]byte(`
 			{
+				"sub":"r3qXcK2bix9eFECzsU3Sbmh0K16fatW6@clients",
 				"color":"red",
 				"temperature":"76"
 			}`))
@@ -742,6 +4834,34 @@ func (o *oidcProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// newTLSOIDCProvider returns a mock provider served over TLS along with the
+// PEM-encoded certificate needed to trust it.
+func newTLSOIDCProvider(t *testing.T) (*oidcProvider, string) {
+	o := new(oidcProvider)
+	o.t = t
+	o.server = httptest.NewTLSServer(o)
+
+	caPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: o.server.Certificate().Raw,
+	})
+
+	return o, string(caPEM)
+}
+
+// assertErrorCode fails the test unless resp is an error response carrying
+// the given error code.
+func assertErrorCode(t *testing.T, resp *logical.Response, code string) {
+	t.Helper()
+
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected error response, got: %#v", resp)
+	}
+	if actual := resp.Headers[errorCodeHeader]; len(actual) != 1 || actual[0] != code {
+		t.Fatalf("expected error code %q, got %q", code, actual)
+	}
+}
+
 func getQueryParam(t *testing.T, inputURL, param string) string {
 	t.Helper()
 
@@ -800,6 +4920,8 @@ func TestOIDC_ValidRedirect(t *testing.T) {
 		{"https://127.0.0.1:9000", []string{"a", "b", "https://127.0.0.1:5000"}, true},
 		{"https://[::1]:9000", []string{"a", "b", "https://[::1]:5000"}, true},
 		{"https://[::1]:9000/x/y?r=42", []string{"a", "b", "https://[::1]:5000/x/y?r=42"}, true},
+		{"https://pr-123.apps.example.com/callback", []string{"a", "https://*.apps.example.com/callback"}, true},
+		{"https://pr-123.apps.example.com:8443/callback", []string{"https://*.apps.example.com:8443/callback"}, true},
 
 		// invalid
 		{"https://example.com", []string{}, false},
@@ -810,6 +4932,15 @@ func TestOIDC_ValidRedirect(t *testing.T) {
 		{"https://localhost:5000", []string{"a", "b", "https://127.0.0.1:5000"}, false},
 		{"https://localhost:5000", []string{"a", "b", "http://localhost:5000"}, false},
 		{"https://[::1]:5000/x/y?r=42", []string{"a", "b", "https://[::1]:5000/x/y?r=43"}, false},
+		{"https://apps.example.com/callback", []string{"https://*.apps.example.com/callback"}, false},
+		{"https://a.b.apps.example.com/callback", []string{"https://*.apps.example.com/callback"}, false},
+		{"http://pr-123.apps.example.com/callback", []string{"https://*.apps.example.com/callback"}, false},
+		{"https://pr-123.apps.example.com/other", []string{"https://*.apps.example.com/callback"}, false},
+		{"https://pr-123.apps.example.com:8443/callback", []string{"https://*.apps.example.com/callback"}, false},
+		{"https://pr-123.apps.example.com.evil.com/callback", []string{"https://*.apps.example.com/callback"}, false},
+		{"https://evil.com/callback", []string{"https://*"}, false},
+		{"https://example.com/callback", []string{"https://*.com/callback"}, false},
+		{"https://pr-123.apps.example.com/callback", []string{"https://pr-*.apps.example.com/callback"}, false},
 	}
 	for _, test := range tests {
 		if validRedirect(test.uri, test.allowed) != test.expected {
@@ -817,3 +4948,27 @@ func TestOIDC_ValidRedirect(t *testing.T) {
 		}
 	}
 }
+
+func TestOIDC_ValidAnyRedirect(t *testing.T) {
+	tests := []struct {
+		uri      string
+		expected bool
+	}{
+		{"https://example.com", true},
+		{"https://pr-123.apps.example.com:8443/callback", true},
+		{"http://localhost:8250/oidc/callback", true},
+		{"http://127.0.0.1:8250/oidc/callback", true},
+		{"http://[::1]:8250/oidc/callback", true},
+
+		{"http://example.com/callback", false},
+		{"ftp://example.com/callback", false},
+		{"https:///callback", false},
+		{"/callback", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if validAnyRedirect(test.uri) != test.expected {
+			t.Fatalf("Fail on %s. Expected: %t", test.uri, test.expected)
+		}
+	}
+}
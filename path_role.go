@@ -4,6 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,7 +18,18 @@ import (
 	"github.com/hashicorp/vault/logical/framework"
 )
 
-var reservedMetadata = []string{"role"}
+var reservedMetadata = []string{"role", "groups_source", "groups_count", "id_token"}
+
+const (
+	boundClaimsTypeString = "string"
+	boundClaimsTypeGlob   = "glob"
+	boundClaimsTypeRegex  = "regex"
+
+	boundClaimsTokenID     = "id_token"
+	boundClaimsTokenAccess = "access_token"
+
+	defaultClaimMappingsDelimiter = ","
+)
 
 func pathRoleList(b *jwtAuthBackend) *framework.Path {
 	return &framework.Path{
@@ -78,21 +92,96 @@ TTL will be set to the value of this parameter.`,
 				Type:        framework.TypeCommaStringSlice,
 				Description: `Comma-separated list of 'aud' claims that are valid for login; any match is sufficient`,
 			},
+			"bound_audiences_strict": {
+				Type: framework.TypeBool,
+				Description: `If true, tokens verified against the OIDC provider, including those
+received by the OIDC callback, are rejected when they contain an 'aud' claim
+but the role has no 'bound_audiences'. If false, the 'aud' claim is only
+checked when 'bound_audiences' is set. JWT logins using 'jwt_validation_pubkeys'
+or 'jwks_url' are always strict. Defaults to false.`,
+			},
+			"bound_token_ttl": {
+				Type: framework.TypeBool,
+				Description: `If true, the TTL and max TTL of Vault tokens issued for this role are
+capped at the time remaining until the login token's 'exp' claim, including on
+renewal. Defaults to false.`,
+			},
+			"expose_id_token": {
+				Type: framework.TypeBool,
+				Description: `If true, the verified ID token received by the OIDC callback is stored
+in the 'id_token' metadata of the issued Vault token. The ID token is a
+credential: it is visible to anyone who can look up the Vault token and in
+audit logs. Defaults to false.`,
+			},
+			"bound_issuer": {
+				Type: framework.TypeString,
+				Description: `The value against which to match the 'iss' claim in a JWT. Overrides the
+'bound_issuer' set on the config. Optional.`,
+			},
+			"jwt_supported_algs": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `A list of signing algorithms accepted for this role. If 'jwt_supported_algs' is
+also set on the config, only algorithms in both lists are accepted. If not set, the config's list
+applies.`,
+			},
+			"bound_claims_type": {
+				Type:        framework.TypeString,
+				Description: `How to interpret values in the map of claims/values (which must match for login): allowed values are 'string', 'glob' or 'regex'. Regular expressions use RE2 syntax, are not anchored, and are matched against the claim's string value.`,
+				Default:     boundClaimsTypeString,
+			},
+			"bound_claims_token": {
+				Type: framework.TypeString,
+				Description: `The token whose claims are checked against 'bound_claims' during OIDC login:
+'id_token' or 'access_token'. The access token must be a JWT signed by the provider. Other claim
+checks always use the ID token. Defaults to 'id_token'.`,
+				Default: boundClaimsTokenID,
+			},
 			"bound_claims": {
 				Type:        framework.TypeMap,
-				Description: `Map of claims/values which must match for login`,
+				Description: `Map of claims/values which must match for login. Claims may be JSON pointers, which can address list elements by index, e.g. '/roles/0'. An object value must equal the claim exactly. Numbers are stored, and returned when reading the role, in their canonical form, e.g. 42.0 as 42.`,
+			},
+			"forbidden_claims": {
+				Type:        framework.TypeMap,
+				Description: `Map of claims/values which deny login if any of them match, e.g. to block suspended accounts. Values are matched exactly; a list of values matches any of them. Checked after 'bound_claims'.`,
+			},
+			"required_claims": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `Comma-separated list of claims which must be present and non-empty for login, regardless of their value. Claims may be JSON pointers.`,
 			},
 			"claim_mappings": {
-				Type:        framework.TypeKVPairs,
-				Description: `Mappings of claims (key) that will be copied to a metadata field (value)`,
+				Type: framework.TypeKVPairs,
+				Description: `Mappings of claims (key) that will be copied to a metadata field (value). A key may
+be a JSON pointer, including list indexes such as '/emails/0', or a template such as
+"{{/dept}}-{{/region}}" that combines several claims.`,
+			},
+			"claim_mappings_delimiter": {
+				Type:        framework.TypeString,
+				Description: `The delimiter used to join the values of list claims referenced in claim_mappings. Defaults to ','.`,
+				Default:     defaultClaimMappingsDelimiter,
 			},
 			"user_claim": {
 				Type:        framework.TypeString,
-				Description: `The claim to use for the Identity entity alias name`,
+				Description: `The claim to use for the Identity entity alias name. May be a JSON pointer, e.g. '/profile/id', to use a nested claim; the claim must be a string.`,
+			},
+			"user_claim_template": {
+				Type: framework.TypeString,
+				Description: `A template used to build the Identity entity alias name from several claims,
+e.g. "{{sub}}@{{tenant_id}}". Claims may be JSON pointers. Cannot be used with "user_claim".`,
+			},
+			"user_claim_fallbacks": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Comma-separated list of claims to try, in order, for the Identity entity alias
+name if the user_claim is missing from the token or empty. Requires "user_claim".`,
 			},
 			"groups_claim": {
-				Type:        framework.TypeString,
-				Description: `The claim to use for the Identity group alias names`,
+				Type: framework.TypeCommaStringSlice,
+				Description: `The claim, or comma-separated list of claims, to use for the Identity group
+alias names. The values of all listed claims are merged.`,
+			},
+			"groups_claim_delimiter": {
+				Type: framework.TypeString,
+				Description: `If the groups claim is a single string rather than a list, the delimiter used
+to split it into group names. Defaults to splitting on whitespace.`,
 			},
 			"bound_cidrs": {
 				Type: framework.TypeCommaStringSlice,
@@ -101,11 +190,65 @@ authenticate against this role`,
 			},
 			"oidc_scopes": {
 				Type:        framework.TypeCommaStringSlice,
-				Description: `Comma-separated list of OIDC scopes`,
+				Description: `Comma-separated list of OIDC scopes to request in addition to 'openid', which is always included`,
 			},
 			"allowed_redirect_uris": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Comma-separated list of allowed values for redirect_uri. The host may start
+with a '*.' label, e.g. 'https://*.apps.example.com/callback', to allow any single subdomain label;
+the rest of the URI must match exactly.`,
+			},
+			"allow_all_redirect_uris": {
+				Type: framework.TypeBool,
+				Description: `If set, any https redirect_uri, or http redirect_uri on a loopback address, is
+allowed in addition to 'allowed_redirect_uris'. This is dangerous and only intended for development
+mounts. Defaults to false.`,
+			},
+			"oidc_fetch_userinfo": {
+				Type: framework.TypeBool,
+				Description: `If set, claims from the provider's userinfo endpoint are required during OIDC
+login and a failure to fetch them fails the login. Otherwise they are merged on a best-effort
+basis. ID token claims always take precedence over userinfo claims.`,
+			},
+			"userinfo_claims": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Comma-separated list of userinfo claims to merge into the ID token claims. If
+not set, all userinfo claims are merged.`,
+			},
+			"oidc_require_email_verified": {
+				Type: framework.TypeBool,
+				Description: `If set, OIDC logins require the 'email_verified' claim to be true. Intended for
+roles using an email address as the user_claim. Defaults to false.`,
+			},
+			"oidc_skip_nonce": {
+				Type: framework.TypeBool,
+				Description: `If set, no nonce is sent in the authorization request and the 'nonce' claim of
+the ID token is not checked. This weakens protection against replayed ID tokens and should only be
+used for providers that do not return the nonce. Defaults to false.`,
+			},
+			"oidc_prompt": {
+				Type: framework.TypeString,
+				Description: `The prompt parameter to send to the provider: one of 'none', 'login', 'consent'
+or 'select_account'. Optional.`,
+			},
+			"oidc_max_age": {
+				Type: framework.TypeDurationSecond,
+				Description: `If set, the maximum allowable time since the end-user last actively authenticated
+with the provider. The 'auth_time' claim of the ID token is verified against this value.`,
+			},
+			"oidc_acr_values": {
 				Type:        framework.TypeCommaStringSlice,
-				Description: `Comma-separated list of allowed values for redirect_uri`,
+				Description: `Comma-separated list of Authentication Context Class Reference values to request via 'acr_values'`,
+			},
+			"bound_acr": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Comma-separated list of 'acr' claim values. If set, the ID token returned
+during OIDC login must have an 'acr' claim matching one of these values.`,
+			},
+			"oidc_response_mode": {
+				Type: framework.TypeString,
+				Description: `The response mode to request from the provider, either 'query' or 'form_post'.
+If unset, the provider's default ('query') is used.`,
 			},
 		},
 		ExistenceCheck: b.pathRoleExistenceCheck,
@@ -160,15 +303,103 @@ type jwtRole struct {
 	Period time.Duration `json:"period"`
 
 	// Role binding properties
-	BoundAudiences      []string                      `json:"bound_audiences"`
-	BoundSubject        string                        `json:"bound_subject"`
-	BoundClaims         map[string]interface{}        `json:"bound_claims"`
-	ClaimMappings       map[string]string             `json:"claim_mappings"`
-	BoundCIDRs          []*sockaddr.SockAddrMarshaler `json:"bound_cidrs"`
-	UserClaim           string                        `json:"user_claim"`
-	GroupsClaim         string                        `json:"groups_claim"`
-	OIDCScopes          []string                      `json:"oidc_scopes"`
-	AllowedRedirectURIs []string                      `json:"allowed_redirect_uris"`
+	BoundAudiences           []string                      `json:"bound_audiences"`
+	BoundAudiencesStrict     bool                          `json:"bound_audiences_strict"`
+	BoundTokenTTL            bool                          `json:"bound_token_ttl"`
+	ExposeIDToken            bool                          `json:"expose_id_token"`
+	BoundSubject             string                        `json:"bound_subject"`
+	BoundIssuer              string                        `json:"bound_issuer"`
+	JWTSupportedAlgs         []string                      `json:"jwt_supported_algs"`
+	BoundClaimsType          string                        `json:"bound_claims_type"`
+	BoundClaimsToken         string                        `json:"bound_claims_token"`
+	BoundClaims              map[string]interface{}        `json:"bound_claims"`
+	ForbiddenClaims          map[string]interface{}        `json:"forbidden_claims"`
+	RequiredClaims           []string                      `json:"required_claims"`
+	ClaimMappings            map[string]string             `json:"claim_mappings"`
+	ClaimMappingsDelim       string                        `json:"claim_mappings_delimiter"`
+	BoundCIDRs               []*sockaddr.SockAddrMarshaler `json:"bound_cidrs"`
+	UserClaim                string                        `json:"user_claim"`
+	UserClaimTemplate        string                        `json:"user_claim_template"`
+	UserClaimFallbacks       []string                      `json:"user_claim_fallbacks"`
+	GroupsClaims             []string                      `json:"groups_claims"`
+	GroupsClaimDelim         string                        `json:"groups_claim_delimiter"`
+	OIDCScopes               []string                      `json:"oidc_scopes"`
+	AllowedRedirectURIs      []string                      `json:"allowed_redirect_uris"`
+	AllowAllRedirectURIs     bool                          `json:"allow_all_redirect_uris"`
+	OIDCResponseMode         string                        `json:"oidc_response_mode"`
+	OIDCFetchUserInfo        bool                          `json:"oidc_fetch_userinfo"`
+	UserInfoClaims           []string                      `json:"userinfo_claims"`
+	OIDCRequireEmailVerified bool                          `json:"oidc_require_email_verified"`
+	OIDCSkipNonce            bool                          `json:"oidc_skip_nonce"`
+	OIDCPrompt               string                        `json:"oidc_prompt"`
+	OIDCMaxAge               time.Duration                 `json:"oidc_max_age"`
+	OIDCACRValues            []string                      `json:"oidc_acr_values"`
+	BoundACR                 []string                      `json:"bound_acr"`
+
+	// Deprecated by GroupsClaims
+	LegacyGroupsClaim string `json:"groups_claim,omitempty"`
+}
+
+// boundIssuer returns the issuer that tokens for this role must match. The
+// role's bound_issuer takes precedence over the one set on the config.
+func (r *jwtRole) boundIssuer(config *jwtConfig) string {
+	if r.BoundIssuer != "" {
+		return r.BoundIssuer
+	}
+	return config.BoundIssuer
+}
+
+// supportedAlgs returns the signing algorithms accepted for this role: the
+// intersection of the role's and the config's jwt_supported_algs, or whichever
+// of them is set. An empty result means that the defaults apply.
+func (r *jwtRole) supportedAlgs(config *jwtConfig) ([]string, error) {
+	switch {
+	case len(r.JWTSupportedAlgs) == 0:
+		return config.JWTSupportedAlgs, nil
+	case len(config.JWTSupportedAlgs) == 0:
+		return r.JWTSupportedAlgs, nil
+	}
+
+	var algs []string
+	for _, alg := range r.JWTSupportedAlgs {
+		if strutil.StrListContains(config.JWTSupportedAlgs, alg) {
+			algs = append(algs, alg)
+		}
+	}
+	if len(algs) == 0 {
+		return nil, errors.New("none of the role's supported signing algorithms are allowed by the config")
+	}
+	return algs, nil
+}
+
+// leaseTTLs returns the TTL and max TTL of tokens issued for this role. With
+// bound_token_ttl set, both are capped at the time remaining until the login
+// token's expiry, if it was recorded in the auth's internal data.
+func (r *jwtRole) leaseTTLs(internalData map[string]interface{}) (time.Duration, time.Duration) {
+	ttl, maxTTL := r.TTL, r.MaxTTL
+	if !r.BoundTokenTTL {
+		return ttl, maxTTL
+	}
+
+	expiry, ok := claimTime(internalData[tokenExpiryKey])
+	if !ok {
+		return ttl, maxTTL
+	}
+
+	// A zero TTL would mean the system default, so a token that has just
+	// expired (but was accepted within the allowed leeway) gets a minimal one.
+	remaining := time.Until(expiry)
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	if ttl == 0 || ttl > remaining {
+		ttl = remaining
+	}
+	if maxTTL == 0 || maxTTL > remaining {
+		maxTTL = remaining
+	}
+
+	return ttl, maxTTL
 }
 
 // role takes a storage backend and the name and returns the role's storage
@@ -192,6 +423,29 @@ func (b *jwtAuthBackend) role(ctx context.Context, s logical.Storage, name strin
 		role.RoleType = "jwt"
 	}
 
+	// Report legacy roles as using exact bound claim matching
+	if role.BoundClaimsType == "" {
+		role.BoundClaimsType = boundClaimsTypeString
+	}
+
+	// Report legacy roles as checking bound claims against the ID token
+	if role.BoundClaimsToken == "" {
+		role.BoundClaimsToken = boundClaimsTokenID
+	}
+
+	// Report legacy roles as joining list claims with the default delimiter
+	if role.ClaimMappingsDelim == "" {
+		role.ClaimMappingsDelim = defaultClaimMappingsDelimiter
+	}
+
+	// Upgrade legacy roles with a single groups claim
+	if role.LegacyGroupsClaim != "" {
+		if len(role.GroupsClaims) == 0 {
+			role.GroupsClaims = []string{role.LegacyGroupsClaim}
+		}
+		role.LegacyGroupsClaim = ""
+	}
+
 	return role, nil
 }
 
@@ -210,6 +464,7 @@ func (b *jwtAuthBackend) pathRoleList(ctx context.Context, req *logical.Request,
 	if err != nil {
 		return nil, err
 	}
+	sort.Strings(roles)
 	return logical.ListResponse(roles), nil
 }
 
@@ -228,23 +483,55 @@ func (b *jwtAuthBackend) pathRoleRead(ctx context.Context, req *logical.Request,
 		return nil, nil
 	}
 
+	// Issued tokens are also bounded by the mount's max TTL, which may be
+	// lower than the role's.
+	effectiveMaxTTL := b.System().MaxLeaseTTL()
+	if role.MaxTTL > 0 && role.MaxTTL < effectiveMaxTTL {
+		effectiveMaxTTL = role.MaxTTL
+	}
+
 	// Create a map of data to be returned
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"role_type":             role.RoleType,
-			"policies":              role.Policies,
-			"num_uses":              role.NumUses,
-			"period":                int64(role.Period.Seconds()),
-			"ttl":                   int64(role.TTL.Seconds()),
-			"max_ttl":               int64(role.MaxTTL.Seconds()),
-			"bound_audiences":       role.BoundAudiences,
-			"bound_subject":         role.BoundSubject,
-			"bound_cidrs":           role.BoundCIDRs,
-			"bound_claims":          role.BoundClaims,
-			"claim_mappings":        role.ClaimMappings,
-			"user_claim":            role.UserClaim,
-			"groups_claim":          role.GroupsClaim,
-			"allowed_redirect_uris": role.AllowedRedirectURIs,
+			"role_type":                   role.RoleType,
+			"policies":                    role.Policies,
+			"num_uses":                    role.NumUses,
+			"period":                      int64(role.Period.Seconds()),
+			"ttl":                         int64(role.TTL.Seconds()),
+			"max_ttl":                     int64(role.MaxTTL.Seconds()),
+			"effective_max_ttl":           int64(effectiveMaxTTL.Seconds()),
+			"bound_audiences":             role.BoundAudiences,
+			"bound_audiences_strict":      role.BoundAudiencesStrict,
+			"bound_token_ttl":             role.BoundTokenTTL,
+			"expose_id_token":             role.ExposeIDToken,
+			"bound_subject":               role.BoundSubject,
+			"bound_issuer":                role.BoundIssuer,
+			"jwt_supported_algs":          role.JWTSupportedAlgs,
+			"bound_cidrs":                 role.BoundCIDRs,
+			"bound_claims_type":           role.BoundClaimsType,
+			"bound_claims_token":          role.BoundClaimsToken,
+			"bound_claims":                role.BoundClaims,
+			"forbidden_claims":            role.ForbiddenClaims,
+			"required_claims":             role.RequiredClaims,
+			"claim_mappings":              role.ClaimMappings,
+			"claim_mappings_delimiter":    role.ClaimMappingsDelim,
+			"user_claim":                  role.UserClaim,
+			"user_claim_template":         role.UserClaimTemplate,
+			"user_claim_fallbacks":        role.UserClaimFallbacks,
+			"groups_claim":                strings.Join(role.GroupsClaims, ","),
+			"groups_claim_delimiter":      role.GroupsClaimDelim,
+			"allowed_redirect_uris":       role.AllowedRedirectURIs,
+			"allow_all_redirect_uris":     role.AllowAllRedirectURIs,
+			"oidc_scopes":                 role.OIDCScopes,
+			"oidc_response_mode":          role.OIDCResponseMode,
+			"oidc_fetch_userinfo":         role.OIDCFetchUserInfo,
+			"userinfo_claims":             role.UserInfoClaims,
+			"oidc_require_email_verified": role.OIDCRequireEmailVerified,
+			"oidc_skip_nonce":             role.OIDCSkipNonce,
+			"oidc_prompt":                 role.OIDCPrompt,
+			"oidc_max_age":                int64(role.OIDCMaxAge.Seconds()),
+			"oidc_acr_values":             role.OIDCACRValues,
+			"bound_acr":                   role.BoundACR,
 		},
 	}
 
@@ -336,10 +623,33 @@ func (b *jwtAuthBackend) pathRoleCreateUpdate(ctx context.Context, req *logical.
 		role.BoundAudiences = boundAudiences.([]string)
 	}
 
+	if boundAudiencesStrict, ok := data.GetOk("bound_audiences_strict"); ok {
+		role.BoundAudiencesStrict = boundAudiencesStrict.(bool)
+	}
+
+	if boundTokenTTL, ok := data.GetOk("bound_token_ttl"); ok {
+		role.BoundTokenTTL = boundTokenTTL.(bool)
+	}
+
+	if exposeIDToken, ok := data.GetOk("expose_id_token"); ok {
+		role.ExposeIDToken = exposeIDToken.(bool)
+	}
+
 	if boundSubject, ok := data.GetOk("bound_subject"); ok {
 		role.BoundSubject = boundSubject.(string)
 	}
 
+	if boundIssuer, ok := data.GetOk("bound_issuer"); ok {
+		role.BoundIssuer = boundIssuer.(string)
+	}
+
+	if supportedAlgs, ok := data.GetOk("jwt_supported_algs"); ok {
+		role.JWTSupportedAlgs = supportedAlgs.([]string)
+		if err := validateSupportedAlgs(role.JWTSupportedAlgs); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
 	if boundCIDRs, ok := data.GetOk("bound_cidrs"); ok {
 		parsedCIDRs, err := parseutil.ParseAddrs(boundCIDRs)
 		if err != nil {
@@ -348,8 +658,61 @@ func (b *jwtAuthBackend) pathRoleCreateUpdate(ctx context.Context, req *logical.
 		role.BoundCIDRs = parsedCIDRs
 	}
 
+	if boundClaimsTypeRaw, ok := data.GetOk("bound_claims_type"); ok {
+		role.BoundClaimsType = boundClaimsTypeRaw.(string)
+	} else if req.Operation == logical.CreateOperation {
+		role.BoundClaimsType = data.Get("bound_claims_type").(string)
+	}
+	switch role.BoundClaimsType {
+	case boundClaimsTypeString, boundClaimsTypeGlob, boundClaimsTypeRegex:
+	default:
+		return logical.ErrorResponse("invalid 'bound_claims_type': %s", role.BoundClaimsType), nil
+	}
+
+	if boundClaimsTokenRaw, ok := data.GetOk("bound_claims_token"); ok {
+		role.BoundClaimsToken = boundClaimsTokenRaw.(string)
+	} else if req.Operation == logical.CreateOperation {
+		role.BoundClaimsToken = data.Get("bound_claims_token").(string)
+	}
+	switch {
+	case role.BoundClaimsToken != boundClaimsTokenID && role.BoundClaimsToken != boundClaimsTokenAccess:
+		return logical.ErrorResponse("invalid 'bound_claims_token': %s", role.BoundClaimsToken), nil
+	case role.BoundClaimsToken == boundClaimsTokenAccess && role.RoleType != "oidc":
+		return logical.ErrorResponse("'bound_claims_token' can only be '%s' for OIDC roles", boundClaimsTokenAccess), nil
+	}
+
 	if boundClaimsRaw, ok := data.GetOk("bound_claims"); ok {
-		role.BoundClaims = boundClaimsRaw.(map[string]interface{})
+		role.BoundClaims = normalizeBoundClaims(boundClaimsRaw.(map[string]interface{}))
+	}
+
+	if role.BoundClaimsType == boundClaimsTypeGlob || role.BoundClaimsType == boundClaimsTypeRegex {
+		for claim, value := range role.BoundClaims {
+			if !isStringOrStringList(value) {
+				return logical.ErrorResponse("bound claim %q must be a string or list of strings when 'bound_claims_type' is '%s'", claim, role.BoundClaimsType), nil
+			}
+		}
+	}
+
+	if role.BoundClaimsType == boundClaimsTypeRegex {
+		for claim, value := range role.BoundClaims {
+			patterns, ok := value.([]interface{})
+			if !ok {
+				patterns = []interface{}{value}
+			}
+			for _, pattern := range patterns {
+				if _, err := regexp.Compile(pattern.(string)); err != nil {
+					return logical.ErrorResponse("invalid regular expression for bound claim %q: %s", claim, err.Error()), nil
+				}
+			}
+		}
+	}
+
+	if forbiddenClaimsRaw, ok := data.GetOk("forbidden_claims"); ok {
+		role.ForbiddenClaims = forbiddenClaimsRaw.(map[string]interface{})
+	}
+
+	if requiredClaims, ok := data.GetOk("required_claims"); ok {
+		role.RequiredClaims = requiredClaims.([]string)
 	}
 
 	if claimMappingsRaw, ok := data.GetOk("claim_mappings"); ok {
@@ -371,15 +734,41 @@ func (b *jwtAuthBackend) pathRoleCreateUpdate(ctx context.Context, req *logical.
 		role.ClaimMappings = claimMappings
 	}
 
+	if claimMappingsDelimRaw, ok := data.GetOk("claim_mappings_delimiter"); ok {
+		role.ClaimMappingsDelim = claimMappingsDelimRaw.(string)
+	} else if req.Operation == logical.CreateOperation {
+		role.ClaimMappingsDelim = data.Get("claim_mappings_delimiter").(string)
+	}
+	if role.ClaimMappingsDelim == "" {
+		return logical.ErrorResponse("'claim_mappings_delimiter' must not be empty"), nil
+	}
+
 	if userClaim, ok := data.GetOk("user_claim"); ok {
 		role.UserClaim = userClaim.(string)
 	}
-	if role.UserClaim == "" {
+	if userClaimTemplate, ok := data.GetOk("user_claim_template"); ok {
+		role.UserClaimTemplate = userClaimTemplate.(string)
+	}
+	if userClaimFallbacks, ok := data.GetOk("user_claim_fallbacks"); ok {
+		role.UserClaimFallbacks = userClaimFallbacks.([]string)
+	}
+	switch {
+	case role.UserClaim == "" && role.UserClaimTemplate == "":
 		return logical.ErrorResponse("a user claim must be defined on the role"), nil
+	case role.UserClaim != "" && role.UserClaimTemplate != "":
+		return logical.ErrorResponse("only one of 'user_claim' and 'user_claim_template' may be set"), nil
+	case role.UserClaimTemplate != "" && !isClaimTemplate(role.UserClaimTemplate):
+		return logical.ErrorResponse("'user_claim_template' must reference at least one claim"), nil
+	case len(role.UserClaimFallbacks) > 0 && role.UserClaim == "":
+		return logical.ErrorResponse("'user_claim_fallbacks' requires 'user_claim' to be set"), nil
+	}
+
+	if groupsClaims, ok := data.GetOk("groups_claim"); ok {
+		role.GroupsClaims = groupsClaims.([]string)
 	}
 
-	if groupsClaim, ok := data.GetOk("groups_claim"); ok {
-		role.GroupsClaim = groupsClaim.(string)
+	if groupsClaimDelim, ok := data.GetOk("groups_claim_delimiter"); ok {
+		role.GroupsClaimDelim = groupsClaimDelim.(string)
 	}
 
 	if oidcScopes, ok := data.GetOk("oidc_scopes"); ok {
@@ -388,9 +777,71 @@ func (b *jwtAuthBackend) pathRoleCreateUpdate(ctx context.Context, req *logical.
 
 	if allowedRedirectURIs, ok := data.GetOk("allowed_redirect_uris"); ok {
 		role.AllowedRedirectURIs = allowedRedirectURIs.([]string)
+
+		// Catch typos such as a missing scheme early rather than when the
+		// redirect URI is compared during login.
+		for _, uri := range role.AllowedRedirectURIs {
+			parsed, err := url.Parse(uri)
+			if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				return logical.ErrorResponse("invalid redirect URI %q in 'allowed_redirect_uris': must be an absolute URL with a scheme and host", uri), nil
+			}
+			if strings.Contains(parsed.Host, "*") && !validWildcardHost(parsed.Hostname()) {
+				return logical.ErrorResponse("invalid redirect URI %q in 'allowed_redirect_uris': a wildcard must be the first label of a host with at least two further labels", uri), nil
+			}
+		}
+	}
+
+	if allowAllRedirectURIs, ok := data.GetOk("allow_all_redirect_uris"); ok {
+		role.AllowAllRedirectURIs = allowAllRedirectURIs.(bool)
+	}
+
+	if fetchUserInfo, ok := data.GetOk("oidc_fetch_userinfo"); ok {
+		role.OIDCFetchUserInfo = fetchUserInfo.(bool)
+	}
+
+	if userInfoClaims, ok := data.GetOk("userinfo_claims"); ok {
+		role.UserInfoClaims = userInfoClaims.([]string)
+	}
+
+	if requireEmailVerified, ok := data.GetOk("oidc_require_email_verified"); ok {
+		role.OIDCRequireEmailVerified = requireEmailVerified.(bool)
+	}
+
+	if skipNonce, ok := data.GetOk("oidc_skip_nonce"); ok {
+		role.OIDCSkipNonce = skipNonce.(bool)
+	}
+
+	if oidcPrompt, ok := data.GetOk("oidc_prompt"); ok {
+		role.OIDCPrompt = oidcPrompt.(string)
+	}
+	switch role.OIDCPrompt {
+	case "", "none", "login", "consent", "select_account":
+	default:
+		return logical.ErrorResponse("invalid 'oidc_prompt': %s", role.OIDCPrompt), nil
+	}
+
+	if oidcMaxAge, ok := data.GetOk("oidc_max_age"); ok {
+		role.OIDCMaxAge = time.Duration(oidcMaxAge.(int)) * time.Second
+	}
+
+	if oidcACRValues, ok := data.GetOk("oidc_acr_values"); ok {
+		role.OIDCACRValues = oidcACRValues.([]string)
+	}
+
+	if boundACR, ok := data.GetOk("bound_acr"); ok {
+		role.BoundACR = boundACR.([]string)
 	}
 
-	if role.RoleType == "oidc" && len(role.AllowedRedirectURIs) == 0 {
+	if oidcResponseMode, ok := data.GetOk("oidc_response_mode"); ok {
+		role.OIDCResponseMode = oidcResponseMode.(string)
+	}
+	switch role.OIDCResponseMode {
+	case "", responseModeQuery, responseModeFormPost:
+	default:
+		return logical.ErrorResponse("invalid 'oidc_response_mode': %s", role.OIDCResponseMode), nil
+	}
+
+	if role.RoleType == "oidc" && len(role.AllowedRedirectURIs) == 0 && !role.AllowAllRedirectURIs {
 		return logical.ErrorResponse(
 			"'allowed_redirect_uris' must be set if 'role_type' is 'oidc' or unspecified."), nil
 	}
@@ -411,12 +862,29 @@ func (b *jwtAuthBackend) pathRoleCreateUpdate(ctx context.Context, req *logical.
 	if role.MaxTTL > 0 && role.TTL > role.MaxTTL {
 		return logical.ErrorResponse("ttl should not be greater than max_ttl"), nil
 	}
+	if role.MaxTTL > 0 && role.Period > role.MaxTTL {
+		return logical.ErrorResponse("period should not be greater than max_ttl"), nil
+	}
 
 	var resp *logical.Response
 	if role.MaxTTL > b.System().MaxLeaseTTL() {
 		resp = &logical.Response{}
 		resp.AddWarning("max_ttl is greater than the system or backend mount's maximum TTL value; issued tokens' max TTL value will be truncated")
 	}
+	if role.OIDCSkipNonce {
+		b.Logger().Warn("oidc_skip_nonce is enabled; ID tokens will not be checked against a nonce", "role", roleName)
+		if resp == nil {
+			resp = &logical.Response{}
+		}
+		resp.AddWarning("oidc_skip_nonce is enabled; ID tokens will not be checked against a nonce, which weakens replay protection")
+	}
+	if role.AllowAllRedirectURIs {
+		b.Logger().Warn("allow_all_redirect_uris is enabled; any https or loopback redirect_uri will be accepted", "role", roleName)
+		if resp == nil {
+			resp = &logical.Response{}
+		}
+		resp.AddWarning("allow_all_redirect_uris is enabled; any https or loopback redirect_uri will be accepted, which should only be used for development")
+	}
 
 	// Store the entry.
 	entry, err := logical.StorageEntryJSON(rolePrefix+roleName, role)
@@ -430,6 +898,22 @@ func (b *jwtAuthBackend) pathRoleCreateUpdate(ctx context.Context, req *logical.
 	return resp, nil
 }
 
+// isStringOrStringList reports whether v is a string or a list containing only strings.
+func isStringOrStringList(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return true
+	case []interface{}:
+		for _, e := range v {
+			if _, ok := e.(string); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 // roleStorageEntry stores all the options that are set on an role
 var roleHelp = map[string][2]string{
 	"role-list": {
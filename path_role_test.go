@@ -3,6 +3,7 @@ package jwtauth
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
@@ -64,8 +65,11 @@ func TestPath_Create(t *testing.T) {
 		Period:              3 * time.Second,
 		BoundSubject:        "testsub",
 		BoundAudiences:      []string{"vault"},
+		BoundClaimsType:     "string",
+		BoundClaimsToken:    "id_token",
+		ClaimMappingsDelim:  ",",
 		UserClaim:           "user",
-		GroupsClaim:         "groups",
+		GroupsClaims:        []string{"groups"},
 		TTL:                 1 * time.Second,
 		MaxTTL:              5 * time.Second,
 		NumUses:             12,
@@ -140,6 +144,66 @@ func TestPath_Create(t *testing.T) {
 	if !strings.HasPrefix(resp.Error().Error(), "must have at least one bound constraint") {
 		t.Fatalf("unexpected err: %v", resp)
 	}
+
+	// Test period greater than max_ttl
+	data = map[string]interface{}{
+		"role_type":     "jwt",
+		"bound_subject": "testsub",
+		"user_claim":    "user",
+		"period":        "10s",
+		"max_ttl":       "5s",
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test2",
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != nil && !resp.IsError() {
+		t.Fatalf("expected error")
+	}
+	if resp.Error().Error() != "period should not be greater than max_ttl" {
+		t.Fatalf("unexpected err: %v", resp)
+	}
+
+	// Test user_claim_template validation
+	templateTests := map[string]map[string]interface{}{
+		"only one of 'user_claim' and 'user_claim_template' may be set": {
+			"user_claim":          "user",
+			"user_claim_template": "{{sub}}@{{tenant}}",
+		},
+		"'user_claim_template' must reference at least one claim": {
+			"user_claim_template": "static",
+		},
+	}
+	for expected, data := range templateTests {
+		data["role_type"] = "jwt"
+		data["bound_subject"] = "testsub"
+
+		req = &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "role/test2",
+			Storage:   storage,
+			Data:      data,
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil || !resp.IsError() {
+			t.Fatalf("expected error")
+		}
+		if resp.Error().Error() != expected {
+			t.Fatalf("unexpected err: %v", resp)
+		}
+	}
 }
 
 func TestPath_OIDCCreate(t *testing.T) {
@@ -167,10 +231,13 @@ func TestPath_OIDCCreate(t *testing.T) {
 	}
 
 	expected := &jwtRole{
-		RoleType:       "oidc",
-		Policies:       []string{"test"},
-		Period:         3 * time.Second,
-		BoundAudiences: []string{"vault"},
+		RoleType:           "oidc",
+		Policies:           []string{"test"},
+		Period:             3 * time.Second,
+		BoundAudiences:     []string{"vault"},
+		BoundClaimsType:    "string",
+		BoundClaimsToken:   "id_token",
+		ClaimMappingsDelim: ",",
 		BoundClaims: map[string]interface{}{
 			"foo": json.Number("10"),
 			"bar": "baz",
@@ -180,12 +247,12 @@ func TestPath_OIDCCreate(t *testing.T) {
 			"foo": "a",
 			"bar": "b",
 		},
-		OIDCScopes:  []string{"email", "profile"},
-		UserClaim:   "user",
-		GroupsClaim: "groups",
-		TTL:         1 * time.Second,
-		MaxTTL:      5 * time.Second,
-		NumUses:     12,
+		OIDCScopes:   []string{"email", "profile"},
+		UserClaim:    "user",
+		GroupsClaims: []string{"groups"},
+		TTL:          1 * time.Second,
+		MaxTTL:       5 * time.Second,
+		NumUses:      12,
 	}
 
 	// test both explicit and default role_type
@@ -259,6 +326,169 @@ func TestPath_OIDCCreate(t *testing.T) {
 	if !strings.Contains(resp.Error().Error(), "multiple keys are mapped to metadata key 'a'") {
 		t.Fatalf("unexpected err: %v", resp)
 	}
+
+	// Test invalid bound claims type
+	data["claim_mappings"] = map[string]string{
+		"foo": "a",
+	}
+	data["bound_claims_type"] = "regexp"
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test2",
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != nil && !resp.IsError() {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(resp.Error().Error(), "invalid 'bound_claims_type'") {
+		t.Fatalf("unexpected err: %v", resp)
+	}
+
+	// Test non-string glob bound claim
+	data["bound_claims_type"] = "glob"
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test2",
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != nil && !resp.IsError() {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(resp.Error().Error(), `bound claim "foo" must be a string`) {
+		t.Fatalf("unexpected err: %v", resp)
+	}
+
+	// Test valid glob bound claims
+	data["bound_claims"] = map[string]interface{}{
+		"email":  "*@example.com",
+		"groups": []interface{}{"admin-*", "ops"},
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test2",
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+	actual, err := b.(*jwtAuthBackend).role(context.Background(), storage, "test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.BoundClaimsType != "glob" {
+		t.Fatalf("unexpected bound_claims_type: %q", actual.BoundClaimsType)
+	}
+
+	// Test invalid regex bound claims are rejected
+	data["bound_claims_type"] = "regex"
+	data["bound_claims"] = map[string]interface{}{
+		"upn": []interface{}{"^[a-z]+@example\\.com$", "(unclosed"},
+	}
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test2",
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(resp.Error().Error(), `invalid regular expression for bound claim "upn"`) {
+		t.Fatalf("unexpected err: %v", resp)
+	}
+
+	// Test valid regex bound claims
+	data["bound_claims"] = map[string]interface{}{
+		"upn": "^[a-z]+@example\\.com$",
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	// Test invalid response mode
+	data["oidc_response_mode"] = "fragment"
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test3",
+		Storage:   storage,
+		Data:      data,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != nil && !resp.IsError() {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(resp.Error().Error(), "invalid 'oidc_response_mode'") {
+		t.Fatalf("unexpected err: %v", resp)
+	}
+
+	// Test allowed redirect URIs
+	delete(data, "oidc_response_mode")
+	for _, test := range []struct {
+		uri         string
+		errExpected bool
+	}{
+		{"https://example.com/callback", false},
+		{"http://localhost:8250/oidc/callback", false},
+		{"example.com/callback", true},
+		{"/oidc/callback", true},
+		{"https://", true},
+		{"https://exa mple.com", true},
+		{"https://*.apps.example.com/callback", false},
+		{"https://*", true},
+		{"https://*.com/callback", true},
+		{"https://pr-*.apps.example.com/callback", true},
+	} {
+		data["allowed_redirect_uris"] = []string{"https://example.com", test.uri}
+
+		req = &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "role/test4",
+			Storage:   storage,
+			Data:      data,
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (resp != nil && resp.IsError()) != test.errExpected {
+			t.Fatalf("uri %q: expected error: %t, got: %#v", test.uri, test.errExpected, resp)
+		}
+		if test.errExpected && !strings.Contains(resp.Error().Error(), fmt.Sprintf("invalid redirect URI %q", test.uri)) {
+			t.Fatalf("uri %q: unexpected err: %v", test.uri, resp.Error())
+		}
+	}
 }
 
 func TestPath_Read(t *testing.T) {
@@ -279,19 +509,44 @@ func TestPath_Read(t *testing.T) {
 	}
 
 	expected := map[string]interface{}{
-		"role_type":             "jwt",
-		"bound_claims":          map[string]interface{}(nil),
-		"claim_mappings":        map[string]string(nil),
-		"bound_subject":         "testsub",
-		"bound_audiences":       []string{"vault"},
-		"allowed_redirect_uris": []string(nil),
-		"user_claim":            "user",
-		"groups_claim":          "groups",
-		"policies":              []string{"test"},
-		"period":                int64(3),
-		"ttl":                   int64(1),
-		"num_uses":              12,
-		"max_ttl":               int64(5),
+		"role_type":                   "jwt",
+		"bound_claims_type":           "string",
+		"bound_claims_token":          "id_token",
+		"bound_claims":                map[string]interface{}(nil),
+		"forbidden_claims":            map[string]interface{}(nil),
+		"claim_mappings":              map[string]string(nil),
+		"claim_mappings_delimiter":    ",",
+		"bound_subject":               "testsub",
+		"bound_issuer":                "",
+		"jwt_supported_algs":          []string(nil),
+		"bound_audiences":             []string{"vault"},
+		"bound_audiences_strict":      false,
+		"bound_token_ttl":             false,
+		"expose_id_token":             false,
+		"allowed_redirect_uris":       []string(nil),
+		"allow_all_redirect_uris":     false,
+		"oidc_scopes":                 []string(nil),
+		"oidc_response_mode":          "",
+		"oidc_fetch_userinfo":         false,
+		"userinfo_claims":             []string(nil),
+		"oidc_require_email_verified": false,
+		"oidc_skip_nonce":             false,
+		"oidc_prompt":                 "",
+		"oidc_max_age":                int64(0),
+		"oidc_acr_values":             []string(nil),
+		"bound_acr":                   []string(nil),
+		"required_claims":             []string(nil),
+		"user_claim":                  "user",
+		"user_claim_template":         "",
+		"user_claim_fallbacks":        []string(nil),
+		"groups_claim":                "groups",
+		"groups_claim_delimiter":      "",
+		"policies":                    []string{"test"},
+		"period":                      int64(3),
+		"ttl":                         int64(1),
+		"num_uses":                    12,
+		"max_ttl":                     int64(5),
+		"effective_max_ttl":           int64(5),
 	}
 
 	req := &logical.Request{
@@ -330,7 +585,8 @@ func TestPath_Read(t *testing.T) {
 	// Run read test for normal case
 	readTest()
 
-	// Remove the 'role_type' parameter in stored role to simulate a legacy role
+	// Remove the 'role_type' parameter and store the groups claim as a single
+	// string in stored role to simulate a legacy role
 	rolePath := rolePrefix + "plugin-test"
 	raw, err := storage.Get(context.Background(), rolePath)
 
@@ -339,6 +595,8 @@ func TestPath_Read(t *testing.T) {
 		t.Fatal(err)
 	}
 	delete(role, "role_type")
+	delete(role, "groups_claims")
+	role["groups_claim"] = "groups"
 	entry, err := logical.StorageEntryJSON(rolePath, role)
 	if err != nil {
 		t.Fatal(err)
@@ -349,8 +607,141 @@ func TestPath_Read(t *testing.T) {
 	}
 
 	// Run read test for "upgrade" case. The legacy role is not changed in storage, but
-	// reads will populate the `role_type` with "jwt".
+	// reads will populate the `role_type` with "jwt" and upgrade the groups claim.
 	readTest()
+
+	// The effective max TTL is bounded by the mount's max TTL of 24 hours
+	for _, test := range []struct {
+		maxTTL   string
+		expected int64
+	}{
+		{"48h", int64((24 * time.Hour).Seconds())},
+		{"0", int64((24 * time.Hour).Seconds())},
+		{"1h", int64(time.Hour.Seconds())},
+	} {
+		req = &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/plugin-test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role_type": "jwt",
+				"max_ttl":   test.maxTTL,
+			},
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+
+		req = &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "role/plugin-test",
+			Storage:   storage,
+		}
+
+		resp, err = b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+		if resp.Data["effective_max_ttl"] != test.expected {
+			t.Fatalf("max_ttl %s: expected effective_max_ttl %d, got %v", test.maxTTL, test.expected, resp.Data["effective_max_ttl"])
+		}
+	}
+}
+
+func TestPath_BoundClaimsNormalized(t *testing.T) {
+	b, storage := getBackend(t)
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/plugin-test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_type":       "jwt",
+			"user_claim":      "user",
+			"bound_audiences": "vault",
+			"bound_claims": map[string]interface{}{
+				"sk":     json.Number("42.0"),
+				"count":  7,
+				"ratio":  0.5,
+				"quoted": "42",
+				"flag":   true,
+				"list":   []interface{}{"a", json.Number("1.50")},
+				"groups": []string{"x", "y"},
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "role/plugin-test",
+		Storage:   storage,
+	}
+
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	expected := map[string]interface{}{
+		"sk":     json.Number("42"),
+		"count":  json.Number("7"),
+		"ratio":  json.Number("0.5"),
+		"quoted": "42",
+		"flag":   true,
+		"list":   []interface{}{"a", json.Number("1.5")},
+		"groups": []interface{}{"x", "y"},
+	}
+	if diff := deep.Equal(resp.Data["bound_claims"], expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestPath_SupportedAlgs(t *testing.T) {
+	b, storage := getBackend(t)
+
+	tests := []struct {
+		algs      []string
+		errPrefix string
+	}{
+		{[]string{"RS256", "ES256"}, ""},
+		{[]string{"HS256"}, "Invalid supported algorithm"},
+		{[]string{"none"}, "the 'none' algorithm cannot be used"},
+	}
+
+	for _, test := range tests {
+		req := &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "role/plugin-test",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role_type":          "jwt",
+				"user_claim":         "user",
+				"bound_audiences":    "vault",
+				"jwt_supported_algs": test.algs,
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.errPrefix == "" {
+			if resp != nil && resp.IsError() {
+				t.Fatalf("algs %v: unexpected error: %v", test.algs, resp.Error())
+			}
+			continue
+		}
+		if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), test.errPrefix) {
+			t.Fatalf("algs %v: expected error %q, got: %#v", test.algs, test.errPrefix, resp)
+		}
+	}
 }
 
 func TestPath_Delete(t *testing.T) {
@@ -412,3 +803,52 @@ func TestPath_Delete(t *testing.T) {
 		t.Fatalf("Unexpected resp data: expected nil got %#v\n", resp.Data)
 	}
 }
+
+func TestPath_List(t *testing.T) {
+	b, storage := getBackend(t)
+
+	listRoles := func() *logical.Response {
+		t.Helper()
+
+		req := &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "role/",
+			Storage:   storage,
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+		return resp
+	}
+
+	resp := listRoles()
+	if _, ok := resp.Data["keys"]; ok {
+		t.Fatalf("expected no keys, got %#v", resp.Data)
+	}
+
+	for _, name := range []string{"web", "admin", "dev"} {
+		req := &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "role/" + name,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role_type":     "jwt",
+				"bound_subject": "testsub",
+				"user_claim":    "user",
+			},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+	}
+
+	resp = listRoles()
+	expected := []string{"admin", "dev", "web"}
+	if diff := deep.Equal(resp.Data["keys"], expected); diff != nil {
+		t.Fatal(diff)
+	}
+}